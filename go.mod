@@ -3,10 +3,12 @@ module github.com/deepfabric/thinkkv
 go 1.13
 
 require (
+	github.com/DataDog/zstd v1.4.0
 	github.com/aws/aws-sdk-go v1.31.2
 	github.com/cockroachdb/pebble v0.0.0-20200520203400-48a267ca2401
 	github.com/facebookgo/ensure v0.0.0-20200202191622-63f1cf65ac4c
 	github.com/facebookgo/stack v0.0.0-20160209184415-751773369052 // indirect
 	github.com/facebookgo/subset v0.0.0-20200203212716-c811ad88dec4 // indirect
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/tecbot/gorocksdb v0.0.0-20191217155057-f0fad39f321c
 )
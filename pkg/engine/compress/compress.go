@@ -0,0 +1,231 @@
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/DataDog/zstd"
+	"github.com/deepfabric/thinkkv/pkg/engine"
+	"github.com/golang/snappy"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// New returns an engine.DB which compresses values larger than cfg.Threshold
+// before handing them to d. Values are self-describing, so values written
+// with and without compression, and values written before d was wrapped,
+// can be read back by the same DB. A header is recognized by its magic,
+// codec and the checksum of the payload, a raw value is mistaken for one
+// only if it happens to carry the checksum of its own tail.
+func New(d engine.DB, cfg Config) engine.DB {
+	if cfg.Level == 0 {
+		cfg.Level = zstd.DefaultCompression
+	}
+	return &db{d, cfg}
+}
+
+func (d *db) Sync() error {
+	return d.db.Sync()
+}
+
+func (d *db) Close() error {
+	return d.db.Close()
+}
+
+func (d *db) NewBatch() (engine.Batch, error) {
+	bat, err := d.db.NewBatch()
+	if err != nil {
+		return nil, err
+	}
+	return &batch{bat, &d.cfg}, nil
+}
+
+func (d *db) NewSnapshot() (engine.Snapshot, error) {
+	s, err := d.db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{s}, nil
+}
+
+func (d *db) NewIterator(k []byte) (engine.Iterator, error) {
+	itr, err := d.db.NewIterator(k)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{itr}, nil
+}
+
+func (d *db) NewSSTWriter(name string) (engine.SSTWriter, error) {
+	w, err := d.db.NewSSTWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{w, &d.cfg}, nil
+}
+
+func (d *db) Ingest(paths []string) error {
+	return d.db.Ingest(paths)
+}
+
+func (d *db) Compact(start, end []byte) error {
+	return d.db.Compact(start, end)
+}
+
+func (d *db) EstimateSize(start, end []byte) (*engine.Size, error) {
+	return d.db.EstimateSize(start, end)
+}
+
+func (d *db) Del(k []byte) error {
+	return d.db.Del(k)
+}
+
+func (d *db) Set(k, v []byte) error {
+	v, err := encode(&d.cfg, v)
+	if err != nil {
+		return err
+	}
+	return d.db.Set(k, v)
+}
+
+func (d *db) Get(k []byte) ([]byte, error) {
+	v, err := d.db.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return decode(v)
+}
+
+func (b *batch) Cancel() error {
+	return b.bat.Cancel()
+}
+
+func (b *batch) Commit() error {
+	return b.bat.Commit()
+}
+
+func (b *batch) Del(k []byte) error {
+	return b.bat.Del(k)
+}
+
+func (b *batch) Set(k, v []byte) error {
+	v, err := encode(b.cfg, v)
+	if err != nil {
+		return err
+	}
+	return b.bat.Set(k, v)
+}
+
+func (w *sstWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *sstWriter) Set(k, v []byte) error {
+	v, err := encode(w.cfg, v)
+	if err != nil {
+		return err
+	}
+	return w.w.Set(k, v)
+}
+
+func (itr *iterator) Close() error {
+	return itr.itr.Close()
+}
+
+func (itr *iterator) Next() error {
+	return itr.itr.Next()
+}
+
+func (itr *iterator) Valid() bool {
+	return itr.itr.Valid()
+}
+
+func (itr *iterator) Seek(k []byte) error {
+	return itr.itr.Seek(k)
+}
+
+func (itr *iterator) Key() []byte {
+	return itr.itr.Key()
+}
+
+func (itr *iterator) Value() ([]byte, error) {
+	v, err := itr.itr.Value()
+	if err != nil {
+		return nil, err
+	}
+	return decode(v)
+}
+
+func (s *snapshot) Close() error {
+	return s.s.Close()
+}
+
+func (s *snapshot) Get(k []byte) ([]byte, error) {
+	v, err := s.s.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return decode(v)
+}
+
+func (s *snapshot) NewIterator(k []byte) (engine.Iterator, error) {
+	itr, err := s.s.NewIterator(k)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{itr}, nil
+}
+
+func encode(cfg *Config, v []byte) ([]byte, error) {
+	if cfg.Codec != None && len(v) >= cfg.Threshold {
+		var err error
+		var data []byte
+
+		switch cfg.Codec {
+		case Snappy:
+			data = snappy.Encode(nil, v)
+		case Zstd:
+			data, err = zstd.CompressLevel(nil, v, cfg.Level)
+		default:
+			return nil, errors.New("unsupported codec")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data)+HeaderSize < len(v) {
+			return header(cfg.Codec, data), nil
+		}
+	}
+	if len(v) > 0 && v[0] == Magic { // escape raw values which look like compressed ones
+		return header(None, v), nil
+	}
+	return v, nil
+}
+
+// header prefixes data with the magic, the codec and the checksum of data
+func header(codec int, data []byte) []byte {
+	r := make([]byte, HeaderSize+len(data))
+	r[0], r[1] = Magic, byte(codec)
+	binary.LittleEndian.PutUint32(r[2:], crc32.Checksum(data, castagnoli))
+	copy(r[HeaderSize:], data)
+	return r
+}
+
+func decode(v []byte) ([]byte, error) {
+	if len(v) < HeaderSize || v[0] != Magic || v[1] > Zstd {
+		return v, nil
+	}
+	if binary.LittleEndian.Uint32(v[2:]) != crc32.Checksum(v[HeaderSize:], castagnoli) {
+		return v, nil // a raw value written before the DB was wrapped
+	}
+	switch v[1] {
+	case None:
+		return v[HeaderSize:], nil
+	case Snappy:
+		return snappy.Decode(nil, v[HeaderSize:])
+	case Zstd:
+		return zstd.Decompress(nil, v[HeaderSize:])
+	}
+	return v, nil
+}
@@ -0,0 +1,55 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb"
+)
+
+func TestCompress(t *testing.T) {
+	raw := pb.New("test.db", vfs.NewMem(), 1<<20, false, false)
+	big := bytes.Repeat([]byte("{\"name\": \"thinkkv\"}"), 100)
+	for _, codec := range []int{Snappy, Zstd} {
+		db := New(raw, Config{Codec: codec, Threshold: 64})
+		for _, v := range [][]byte{[]byte("small"), {Magic, 1, 2}, big} {
+			if err := db.Set([]byte("a"), v); err != nil {
+				t.Fatal(err)
+			}
+			if r, err := db.Get([]byte("a")); err != nil || !bytes.Equal(r, v) {
+				t.Fatalf("get %v: %v", codec, err)
+			}
+		}
+		if v, _ := raw.Get([]byte("a")); len(v) >= len(big) {
+			t.Fatalf("value not compressed: %v", len(v))
+		}
+		itr, err := db.NewIterator([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if itr.Seek([]byte("a")); !itr.Valid() {
+			t.Fatal("iterator invalid")
+		}
+		if v, err := itr.Value(); err != nil || !bytes.Equal(v, big) {
+			t.Fatalf("iterator value: %v", err)
+		}
+		itr.Close()
+	}
+}
+
+func TestRawValues(t *testing.T) {
+	raw := pb.New("test.db", vfs.NewMem(), 1<<20, false, false)
+	vs := [][]byte{{Magic, None, 1, 2, 3, 4, 5, 6}, {Magic, Snappy, 0, 0, 0, 0, 7}, {Magic, Zstd}}
+	for i, v := range vs { // written before the DB is wrapped
+		if err := raw.Set([]byte{byte(i)}, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := New(raw, Config{Codec: Zstd})
+	for i, v := range vs {
+		if r, err := db.Get([]byte{byte(i)}); err != nil || !bytes.Equal(r, v) {
+			t.Fatalf("get %v: %v, %v", i, r, err)
+		}
+	}
+}
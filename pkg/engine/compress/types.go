@@ -0,0 +1,48 @@
+package compress
+
+import "github.com/deepfabric/thinkkv/pkg/engine"
+
+const (
+	None = iota
+	Snappy
+	Zstd
+)
+
+const (
+	// Magic marks a value written by this package, it is followed by
+	// one byte of codec type and the crc32c of the payload.
+	Magic = 0xC7
+)
+
+const (
+	HeaderSize = 6
+)
+
+type Config struct {
+	Codec     int
+	Level     int // zstd compression level, 0 for default
+	Threshold int // values shorter than threshold are stored uncompressed
+}
+
+type db struct {
+	db  engine.DB
+	cfg Config
+}
+
+type batch struct {
+	bat engine.Batch
+	cfg *Config
+}
+
+type sstWriter struct {
+	w   engine.SSTWriter
+	cfg *Config
+}
+
+type iterator struct {
+	itr engine.Iterator
+}
+
+type snapshot struct {
+	s engine.Snapshot
+}
@@ -0,0 +1,104 @@
+package limiter
+
+import "github.com/deepfabric/thinkkv/pkg/engine"
+
+// NewDB returns an engine.DB whose writes are admitted by token buckets of
+// operations and bytes. Set and Del on the DB are served with high
+// priority, writes into batches and sst files with low priority.
+func NewDB(d engine.DB, cfg Config) engine.DB {
+	return &db{
+		db:  d,
+		ops: New(cfg.OpsPerSec, 0),
+		bys: New(cfg.BytesPerSec, 0),
+	}
+}
+
+func (d *db) Sync() error {
+	return d.db.Sync()
+}
+
+func (d *db) Close() error {
+	return d.db.Close()
+}
+
+func (d *db) NewBatch() (engine.Batch, error) {
+	bat, err := d.db.NewBatch()
+	if err != nil {
+		return nil, err
+	}
+	return &batch{d, bat}, nil
+}
+
+func (d *db) NewSnapshot() (engine.Snapshot, error) {
+	return d.db.NewSnapshot()
+}
+
+func (d *db) NewIterator(k []byte) (engine.Iterator, error) {
+	return d.db.NewIterator(k)
+}
+
+func (d *db) NewSSTWriter(name string) (engine.SSTWriter, error) {
+	w, err := d.db.NewSSTWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{d, w}, nil
+}
+
+func (d *db) Ingest(paths []string) error {
+	return d.db.Ingest(paths)
+}
+
+func (d *db) Compact(start, end []byte) error {
+	return d.db.Compact(start, end)
+}
+
+func (d *db) EstimateSize(start, end []byte) (*engine.Size, error) {
+	return d.db.EstimateSize(start, end)
+}
+
+func (d *db) Del(k []byte) error {
+	d.wait(len(k), High)
+	return d.db.Del(k)
+}
+
+func (d *db) Set(k, v []byte) error {
+	d.wait(len(k)+len(v), High)
+	return d.db.Set(k, v)
+}
+
+func (d *db) Get(k []byte) ([]byte, error) {
+	return d.db.Get(k)
+}
+
+func (d *db) wait(size int, pri int) {
+	d.ops.Wait(1, pri)
+	d.bys.Wait(size, pri)
+}
+
+func (b *batch) Cancel() error {
+	return b.bat.Cancel()
+}
+
+func (b *batch) Commit() error {
+	return b.bat.Commit()
+}
+
+func (b *batch) Del(k []byte) error {
+	b.d.wait(len(k), Low)
+	return b.bat.Del(k)
+}
+
+func (b *batch) Set(k, v []byte) error {
+	b.d.wait(len(k)+len(v), Low)
+	return b.bat.Set(k, v)
+}
+
+func (w *sstWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *sstWriter) Set(k, v []byte) error {
+	w.d.wait(len(k)+len(v), Low)
+	return w.w.Set(k, v)
+}
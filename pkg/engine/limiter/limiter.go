@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"io"
+	"time"
+)
+
+// New returns a token bucket which is refilled with rate tokens per second
+// and holds at most burst tokens, a nil Limiter never blocks.
+func New(rate, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < rate/10 {
+		burst = rate / 10
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// NewReader returns a reader which takes a token for every byte read.
+func NewReader(r io.Reader, l *Limiter, pri int) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{pri, r, l}
+}
+
+// Wait blocks until n tokens are taken. Requests larger than the burst are
+// served as soon as the bucket is not empty and leave the bucket in debt,
+// so the following requests wait until the debt is paid off.
+func (l *Limiter) Wait(n int, pri int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	waiting := false
+	l.Lock()
+	for {
+		l.refill()
+		if l.tokens > 0 && (pri == High || l.wait[High] == 0) {
+			l.tokens -= float64(n)
+			if waiting {
+				l.wait[pri]--
+			}
+			l.Unlock()
+			return
+		}
+		if !waiting {
+			waiting = true
+			l.wait[pri]++
+		}
+		d := Tick
+		if l.tokens <= 0 {
+			if e := time.Duration((1 - l.tokens) / l.rate * float64(time.Second)); pri == High || e > d {
+				d = e
+			}
+		}
+		l.Unlock()
+		l.sleep(d)
+		l.Lock()
+	}
+}
+
+func (l *Limiter) refill() {
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if max := int(r.l.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	r.l.Wait(n, r.pri)
+	return n, err
+}
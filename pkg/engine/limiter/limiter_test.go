@@ -0,0 +1,80 @@
+package limiter
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(1000, 100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		l.Wait(100, High)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("too fast: %v", d)
+	}
+	var nilLimiter *Limiter
+	nilLimiter.Wait(1<<30, Low)
+}
+
+// clock is a fake clock whose sleepers wake up when it is advanced
+type clock struct {
+	sync.Mutex
+	t        time.Time
+	sleepers []chan struct{}
+	sleeping chan struct{} // signaled by every sleep
+}
+
+func (c *clock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *clock) sleep(time.Duration) {
+	ch := make(chan struct{})
+	c.Lock()
+	c.sleepers = append(c.sleepers, ch)
+	c.Unlock()
+	c.sleeping <- struct{}{}
+	<-ch
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+	for _, ch := range c.sleepers {
+		close(ch)
+	}
+	c.sleepers = nil
+}
+
+func TestPriority(t *testing.T) {
+	clk := &clock{t: time.Now(), sleeping: make(chan struct{}, 4)}
+	l := New(100, 10)
+	l.now, l.sleep, l.last = clk.now, clk.sleep, clk.now()
+	l.Wait(100, High) // drain the bucket
+	ch := make(chan int, 2)
+	go func() {
+		l.Wait(10, Low)
+		ch <- Low
+	}()
+	<-clk.sleeping
+	go func() {
+		l.Wait(10, High)
+		ch <- High
+	}()
+	<-clk.sleeping
+	clk.advance(2 * time.Second) // refills the bucket for one request
+	if pri := <-ch; pri != High {
+		t.Fatal("low priority request served first")
+	}
+	<-clk.sleeping
+	clk.advance(time.Second)
+	if pri := <-ch; pri != Low {
+		t.Fatal("low priority request not served")
+	}
+}
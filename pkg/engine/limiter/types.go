@@ -0,0 +1,57 @@
+package limiter
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/deepfabric/thinkkv/pkg/engine"
+)
+
+const (
+	High = iota // foreground requests
+	Low         // bulk requests, served only when no high priority request is waiting
+)
+
+const (
+	Tick = 10 * time.Millisecond
+)
+
+// token bucket limiter
+type Limiter struct {
+	sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	wait   [2]int // number of waiters of each priority
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+type reader struct {
+	pri int
+	r   io.Reader
+	l   *Limiter
+}
+
+type Config struct {
+	OpsPerSec   int // 0 means unlimited
+	BytesPerSec int // 0 means unlimited
+}
+
+type db struct {
+	db  engine.DB
+	ops *Limiter
+	bys *Limiter
+}
+
+type batch struct {
+	d   *db
+	bat engine.Batch
+}
+
+type sstWriter struct {
+	d *db
+	w engine.SSTWriter
+}
@@ -53,6 +53,22 @@ func (_ *local) NewIterator(_ []byte) (engine.Iterator, error) {
 	return &iterator{}, nil
 }
 
+func (_ *local) NewSSTWriter(_ string) (engine.SSTWriter, error) {
+	return nil, engine.NotSupport
+}
+
+func (_ *local) Ingest(_ []string) error {
+	return engine.NotSupport
+}
+
+func (_ *local) Compact(_, _ []byte) error {
+	return engine.NotSupport
+}
+
+func (_ *local) EstimateSize(_, _ []byte) (*engine.Size, error) {
+	return nil, engine.NotSupport
+}
+
 func (_ *batch) Cancel() error {
 	return nil
 }
@@ -1,34 +1,99 @@
 package pb
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/deepfabric/thinkkv/pkg/engine"
+	"github.com/deepfabric/thinkkv/pkg/engine/limiter"
 )
 
 func New(name string, fs vfs.FS, size int, readOnly, syncWrite bool) engine.DB {
-	if db, err := pebble.Open(name, &pebble.Options{
-		FS:           fs,
+	db, err := Open(name, fs, &Options{
 		MemTableSize: size,
 		ReadOnly:     readOnly,
-		DisableWAL:   !syncWrite,
-	}); err != nil {
+		SyncWrite:    syncWrite,
+	})
+	if err != nil {
 		return nil
-	} else {
-		return &pbEngine{db, &pebble.WriteOptions{syncWrite}}
 	}
+	return db
+}
+
+func Open(name string, fs vfs.FS, o *Options) (engine.DB, error) {
+	opts := (&pebble.Options{
+		FS:            fs,
+		MemTableSize:  o.MemTableSize,
+		ReadOnly:      o.ReadOnly,
+		DisableWAL:    !o.SyncWrite,
+		EventListener: o.EventListener,
+	}).EnsureDefaults()
+	if l, ok := fs.(TableListener); ok {
+		fn := opts.EventListener.TableDeleted
+		opts.EventListener.TableDeleted = func(info pebble.TableDeleteInfo) {
+			l.TableDeleted(info.JobID, info.Path, info.Err)
+			fn(info)
+		}
+	}
+	l, _ := fs.(LevelListener)
+	if l != nil {
+		listenLevels(name, fs, l, &opts.EventListener)
+	}
+	db, err := pebble.Open(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		for level, tables := range db.SSTables() {
+			for _, t := range tables {
+				l.TableLevel(tablePath(name, fs, t.FileNum), level)
+			}
+		}
+	}
+	e := &pbEngine{
+		name:  name,
+		pause: o.PauseOnError,
+		db:    db,
+		opts:  opts,
+		opt:   &pebble.WriteOptions{Sync: o.SyncWrite},
+		stop:  make(chan struct{}),
+	}
+	if fs, ok := fs.(WarmFS); ok && o.WarmUp != nil {
+		if o.WarmUp.Background {
+			e.wg.Add(1)
+			go func() {
+				defer e.wg.Done()
+				e.warm(fs, o.WarmUp)
+			}()
+		} else {
+			e.warm(fs, o.WarmUp)
+		}
+	}
+	return e, nil
 }
 
 func (db *pbEngine) Sync() error {
 	return db.db.Flush()
 }
 
+// Close stops the warm up in background before closing the database.
 func (db *pbEngine) Close() error {
+	select {
+	case <-db.stop:
+	default:
+		close(db.stop)
+	}
+	db.wg.Wait()
 	return db.db.Close()
 }
 
 func (db *pbEngine) NewBatch() (engine.Batch, error) {
-	return &pbBatch{db: db.db, bat: db.db.NewBatch(), opt: db.opt}, nil
+	return &pbBatch{e: db, db: db.db, bat: db.db.NewBatch(), opt: db.opt}, nil
 }
 
 func (db *pbEngine) NewSnapshot() (engine.Snapshot, error) {
@@ -46,21 +111,79 @@ func (db *pbEngine) NewIterator(k []byte) (engine.Iterator, error) {
 	})}, nil
 }
 
+func (db *pbEngine) NewSSTWriter(name string) (engine.SSTWriter, error) {
+	f, err := db.opts.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &pbSSTWriter{sstable.NewWriter(f, db.opts.MakeWriterOptions(0))}, nil
+}
+
+// Ingest loads the sst files into the lsm tree, the files are linked
+// into the database, the caller may remove them after Ingest returns.
+func (db *pbEngine) Ingest(paths []string) error {
+	if err := db.check(); err != nil {
+		return err
+	}
+	return db.db.Ingest(paths)
+}
+
+func (db *pbEngine) Compact(start, end []byte) error {
+	return db.db.Compact(start, end)
+}
+
+// EstimateSize splits the estimated size between local and remote storage
+// in proportion to the sizes of the sst files overlapping the range.
+func (db *pbEngine) EstimateSize(start, end []byte) (*engine.Size, error) {
+	total, err := db.db.EstimateDiskUsage(start, end)
+	if err != nil {
+		return nil, err
+	}
+	fs, ok := db.opts.FS.(CacheFS)
+	if !ok {
+		return &engine.Size{Total: total, Local: total}, nil
+	}
+	var local, remote uint64
+	cmp := db.opts.Comparer.Compare
+	for _, ts := range db.db.SSTables() {
+		for _, t := range ts {
+			if cmp(t.Smallest.UserKey, end) > 0 || cmp(start, t.Largest.UserKey) > 0 {
+				continue
+			}
+			if fs.IsCached(tablePath(db.name, fs, t.FileNum)) {
+				local += t.Size
+			} else {
+				remote += t.Size
+			}
+		}
+	}
+	if local+remote == 0 {
+		return &engine.Size{Total: total, Local: total}, nil
+	}
+	size := &engine.Size{Total: total}
+	size.Local = uint64(float64(total) * float64(local) / float64(local+remote))
+	size.Remote = total - size.Local
+	return size, nil
+}
+
 func (db *pbEngine) Del(k []byte) error {
+	if err := db.check(); err != nil {
+		return err
+	}
 	return db.db.Delete(k, db.opt)
 }
 
 func (db *pbEngine) Set(k, v []byte) error {
+	if err := db.check(); err != nil {
+		return err
+	}
 	return db.db.Set(k, v, db.opt)
 }
 
 func (db *pbEngine) Get(k []byte) ([]byte, error) {
 	v, c, err := db.db.Get(k)
-	if err == pebble.ErrNotFound {
-		err = engine.NotExist
-	}
 	if err != nil {
-		return nil, err
+		return nil, convert(err)
 	}
 	r := make([]byte, len(v))
 	copy(r, v)
@@ -68,11 +191,41 @@ func (db *pbEngine) Get(k []byte) ([]byte, error) {
 	return r, nil
 }
 
+// check returns the error of the filesystem, or waits for it to recover
+// if the engine is paused on errors.
+func (db *pbEngine) check() error {
+	fs, ok := db.opts.FS.(HealthFS)
+	if !ok {
+		return nil
+	}
+	for {
+		err := fs.Err()
+		if err == nil || !db.pause {
+			return err
+		}
+		time.Sleep(PauseInterval)
+	}
+}
+
+// convert maps the errors of pebble and the filesystem to the errors of the engine
+func convert(err error) error {
+	switch {
+	case err == pebble.ErrNotFound:
+		return engine.NotExist
+	case errors.Is(err, engine.Corruption):
+		return engine.Corruption
+	}
+	return err
+}
+
 func (b *pbBatch) Cancel() error {
 	return b.bat.Close()
 }
 
 func (b *pbBatch) Commit() error {
+	if err := b.e.check(); err != nil {
+		return err
+	}
 	return b.bat.Commit(b.opt)
 }
 
@@ -84,6 +237,14 @@ func (b *pbBatch) Set(k, v []byte) error {
 	return b.bat.Set(k, v, b.opt)
 }
 
+func (w *pbSSTWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *pbSSTWriter) Set(k, v []byte) error {
+	return w.w.Set(k, v)
+}
+
 func (itr *pbIterator) Close() error {
 	itr.itr.Close()
 	return nil
@@ -91,7 +252,7 @@ func (itr *pbIterator) Close() error {
 
 func (itr *pbIterator) Next() error {
 	itr.itr.Next()
-	return nil
+	return convert(itr.itr.Error())
 }
 
 func (itr *pbIterator) Valid() bool {
@@ -100,7 +261,7 @@ func (itr *pbIterator) Valid() bool {
 
 func (itr *pbIterator) Seek(k []byte) error {
 	itr.itr.SeekGE(k)
-	return nil
+	return convert(itr.itr.Error())
 }
 
 func (itr *pbIterator) Key() []byte {
@@ -123,11 +284,8 @@ func (s *pbSnapshot) Close() error {
 
 func (s *pbSnapshot) Get(k []byte) ([]byte, error) {
 	v, c, err := s.s.Get(k)
-	if err == pebble.ErrNotFound {
-		err = engine.NotExist
-	}
 	if err != nil {
-		return nil, err
+		return nil, convert(err)
 	}
 	r := make([]byte, len(v))
 	copy(r, v)
@@ -145,3 +303,119 @@ func (s *pbSnapshot) NewIterator(k []byte) (engine.Iterator, error) {
 		UpperBound: u,
 	})}, nil
 }
+
+// listenLevels reports the levels of the tables written by flushes,
+// compactions and ingestions to l.
+func listenLevels(name string, fs vfs.FS, l LevelListener, el *pebble.EventListener) {
+	flushEnd, compactionEnd, tableIngested := el.FlushEnd, el.CompactionEnd, el.TableIngested
+	el.FlushEnd = func(info pebble.FlushInfo) {
+		if info.Err == nil {
+			for _, t := range info.Output {
+				l.TableLevel(tablePath(name, fs, t.FileNum), 0)
+			}
+		}
+		flushEnd(info)
+	}
+	el.CompactionEnd = func(info pebble.CompactionInfo) {
+		if info.Err == nil {
+			for _, t := range info.Output.Tables {
+				l.TableLevel(tablePath(name, fs, t.FileNum), info.Output.Level)
+			}
+		}
+		compactionEnd(info)
+	}
+	el.TableIngested = func(info pebble.TableIngestInfo) {
+		if info.Err == nil {
+			for _, t := range info.Tables {
+				l.TableLevel(tablePath(name, fs, t.FileNum), t.Level)
+			}
+		}
+		tableIngested(info)
+	}
+}
+
+func tablePath(name string, fs vfs.FS, num pebble.FileNum) string {
+	return fs.PathJoin(name, fmt.Sprintf("%s.sst", num))
+}
+
+// warm prefetches the tables selected by w into the cache of fs in
+// parallel, the tables fetched as a whole are reported again to a
+// LevelListener once they are cached.
+func (db *pbEngine) warm(fs WarmFS, w *WarmUp) {
+	type job struct {
+		name      string
+		level     int
+		off, size int64
+		n         int64 // bytes to fetch
+	}
+	var jobs []job
+	var p WarmProgress
+
+	for level, tables := range db.db.SSTables() {
+		for _, t := range tables {
+			j := job{name: tablePath(db.name, fs, t.FileNum), level: level, size: -1, n: int64(t.Size)}
+			if level >= w.Levels {
+				if w.TailSize <= 0 {
+					continue
+				}
+				if j.n > int64(w.TailSize) {
+					j.off, j.n = j.n-int64(w.TailSize), int64(w.TailSize)
+				}
+				j.size = j.n
+			}
+			p.TotalTables++
+			p.TotalBytes += j.n
+			jobs = append(jobs, j)
+		}
+	}
+	n := w.Parallelism
+	if n <= 0 {
+		n = DefaultWarmParallelism
+	}
+	l, _ := fs.(LevelListener)
+	lim := limiter.New(w.BytesPerSec, 0)
+	ch := make(chan job)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				lim.Wait(int(j.n), limiter.Low)
+				err := fs.Prefetch(j.name, j.off, j.size)
+				if err == nil && j.size < 0 && l != nil {
+					l.TableLevel(j.name, j.level)
+				}
+				mu.Lock()
+				p.Tables++
+				if err != nil {
+					p.Failed++
+					if p.Err == nil {
+						p.Err = err
+					}
+				} else {
+					p.Bytes += j.n
+				}
+				if w.Progress != nil {
+					w.Progress(p)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+loop:
+	for _, j := range jobs {
+		select {
+		case ch <- j:
+		case <-db.stop:
+			break loop
+		}
+	}
+	close(ch)
+	wg.Wait()
+	p.Done = true
+	if w.Progress != nil {
+		w.Progress(p)
+	}
+}
@@ -0,0 +1,228 @@
+package pb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
+)
+
+func TestIngest(t *testing.T) {
+	db := New("test.db", vfs.NewMem(), 1<<20, false, false)
+	w, err := db.NewSSTWriter("ext.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.Set([]byte(fmt.Sprintf("%03d", i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ingest([]string{"ext.sst"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("042")); err != nil || v[0] != 42 {
+		t.Fatalf("get: %v, %v", v, err)
+	}
+	db.Close()
+}
+
+func TestIngestS3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	a, fs, err := s3.Open(&s3.Config{CacheSize: 1 << 20, CacheDir: dir}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	db, err := Open("test", a, &Options{MemTableSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := db.NewSSTWriter("test/ext.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.Set([]byte(fmt.Sprintf("%03d", i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ingest([]string{"test/ext.sst"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("042")); err != nil || v[0] != 42 {
+		t.Fatalf("get: %v, %v", v, err)
+	}
+	var names []string
+	for _, ts := range db.(*pbEngine).db.SSTables() {
+		for _, t0 := range ts {
+			names = append(names, tablePath("test", a, t0.FileNum))
+		}
+	}
+	if len(names) != 1 || !a.IsCached(names[0]) {
+		t.Fatalf("ingested tables %v are not cached", names)
+	}
+	db.Close()
+	fs.Close()
+	a.Stop()
+	if _, err := st.Head("test", names[0][len("test/"):]); err != nil {
+		t.Fatalf("ingested table not uploaded: %v", err)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	db := New("test.db", vfs.NewMem(), 1<<20, false, false)
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact([]byte("0000"), []byte("1000")); err != nil {
+		t.Fatal(err)
+	}
+	size, err := db.EstimateSize([]byte("0000"), []byte("1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size.Total == 0 || size.Local != size.Total || size.Remote != 0 {
+		t.Fatalf("size: %+v", size)
+	}
+	db.Close()
+}
+
+func TestEventListener(t *testing.T) {
+	var flushes, tables int
+	db, err := Open("test.db", vfs.NewMem(), &Options{
+		MemTableSize: 1 << 20,
+		EventListener: EventListener{
+			FlushEnd:     func(_ FlushInfo) { flushes++ },
+			TableCreated: func(_ TableCreateInfo) { tables++ },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if flushes != 1 || tables != 1 {
+		t.Fatalf("flushes: %v, tables: %v", flushes, tables)
+	}
+	db.Close()
+}
+
+type levelFS struct {
+	vfs.FS
+	levels map[string]int
+}
+
+func (fs *levelFS) TableLevel(name string, level int) {
+	fs.levels[name] = level
+}
+
+func TestLevelListener(t *testing.T) {
+	fs := &levelFS{vfs.NewMem(), make(map[string]int)}
+	for i := 0; i < 2; i++ {
+		db, err := Open("test.db", fs, &Options{MemTableSize: 1 << 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := db.Set([]byte("a"), []byte("b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+		if level, ok := fs.levels["test.db/000004.sst"]; !ok || level != 0 || len(fs.levels) != 1 {
+			t.Fatalf("levels: %v", fs.levels)
+		}
+		fs.levels = make(map[string]int)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	cfg := &s3.Config{CacheSize: 64 << 20, BlockCacheSize: 1 << 20}
+	warms := []*WarmUp{nil, {Levels: 7}, {TailSize: 4096, Parallelism: 2, BytesPerSec: 1 << 20, Background: true}}
+	for i, w := range warms {
+		cfg.CacheDir = fmt.Sprintf("%s/%v", dir, i)
+		a, fs, err := s3.Open(cfg, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go a.Run()
+		var last WarmProgress
+		done := make(chan struct{})
+		if w != nil {
+			w.Progress = func(p WarmProgress) {
+				last = p
+				if p.Done {
+					close(done)
+				}
+			}
+		}
+		db, err := Open("test", a, &Options{MemTableSize: 256 << 10, SyncWrite: true, WarmUp: w})
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch i {
+		case 0:
+			for j := 0; j < 1000; j++ {
+				if err := db.Set([]byte(fmt.Sprintf("%04d", j)), make([]byte, 1024)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		case 1:
+			if !last.Done || last.TotalTables == 0 || last.Tables != last.TotalTables || last.Failed != 0 || last.Bytes != last.TotalBytes {
+				t.Fatalf("unexpected progress %+v", last)
+			}
+			for _, ts := range db.(*pbEngine).db.SSTables() {
+				for _, t0 := range ts {
+					if name := tablePath("test", a, t0.FileNum); !a.IsCached(name) {
+						t.Fatalf("%v is not cached", name)
+					}
+				}
+			}
+		case 2:
+			<-done
+			if last.TotalTables == 0 || last.Failed != 0 || last.Bytes != last.TotalBytes {
+				t.Fatalf("unexpected progress %+v", last)
+			}
+		}
+		db.Close()
+		fs.Close()
+		a.Stop()
+	}
+}
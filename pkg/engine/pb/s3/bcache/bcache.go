@@ -0,0 +1,174 @@
+package bcache
+
+import (
+	"container/list"
+	"strings"
+)
+
+// New returns a cache of at most limit bytes, readahead is the number of
+// blocks prefetched once a sequential read is detected, 0 disables it.
+// A nil Cache reads through to the store.
+func New(bsize, limit int64, readahead int) *Cache {
+	if limit <= 0 {
+		return nil
+	}
+	if bsize <= 0 {
+		bsize = DefaultBlockSize
+	}
+	c := &Cache{
+		bsize: bsize,
+		limit: limit,
+		ra:    int64(readahead),
+		l:     list.New(),
+		mp:    make(map[key]*list.Element),
+		cs:    make(map[key]*call),
+		seq:   make(map[string]int64),
+	}
+	if readahead > 0 {
+		c.ras = make(chan struct{}, readahead)
+	}
+	return c
+}
+
+// ReadAt reads len(p) bytes of the object name of size at off, missing
+// blocks are loaded by fetch. At most readahead blocks are prefetched at
+// a time, the readahead is skipped while they are in flight.
+func (c *Cache) ReadAt(name string, size int64, p []byte, off int64, fetch Fetch) (int, error) {
+	switch {
+	case off >= size:
+		return 0, nil
+	case off+int64(len(p)) > size:
+		p = p[:size-off]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c == nil {
+		data, err := fetch(off, int64(len(p)))
+		return copy(p, data), err
+	}
+	first, last := off/c.bsize, (off+int64(len(p))-1)/c.bsize
+	c.Lock()
+	next, ok := c.seq[name]
+	c.seq[name] = last + 1
+	c.Unlock()
+	if ok && c.ra > 0 && (first == next || first == next-1) {
+	loop:
+		for b := last + 1; b <= last+c.ra && b*c.bsize < size; b++ {
+			select {
+			case c.ras <- struct{}{}:
+			default:
+				break loop
+			}
+			go func(k key) {
+				c.get(k, size, fetch)
+				<-c.ras
+			}(key{name, b})
+		}
+	}
+	n := 0
+	for b := first; b <= last; b++ {
+		data, err := c.get(key{name, b}, size, fetch)
+		if err != nil {
+			return n, err
+		}
+		start := int64(0)
+		if b == first {
+			start = off - b*c.bsize
+		}
+		n += copy(p[n:], data[start:])
+	}
+	return n, nil
+}
+
+// Invalidate drops all blocks of the object name
+func (c *Cache) Invalidate(name string) {
+	c.invalidate(func(s string) bool { return s == name })
+}
+
+// InvalidatePrefix drops all blocks of the objects whose name starts with prefix
+func (c *Cache) InvalidatePrefix(prefix string) {
+	c.invalidate(func(s string) bool { return strings.HasPrefix(s, prefix) })
+}
+
+// Size returns the number of bytes cached
+func (c *Cache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.size
+}
+
+func (c *Cache) get(k key, size int64, fetch Fetch) ([]byte, error) {
+	c.Lock()
+	if e, ok := c.mp[k]; ok {
+		c.l.MoveToFront(e)
+		c.Unlock()
+		return e.Value.(*block).data, nil
+	}
+	if cl, ok := c.cs[k]; ok {
+		c.Unlock()
+		cl.wg.Wait()
+		return cl.data, cl.err
+	}
+	cl := new(call)
+	cl.wg.Add(1)
+	c.cs[k] = cl
+	c.Unlock()
+	n := c.bsize
+	if off := k.blk * c.bsize; off+n > size {
+		n = size - off
+	}
+	cl.data, cl.err = fetch(k.blk*c.bsize, n)
+	if cl.err == nil && int64(len(cl.data)) != n {
+		cl.data, cl.err = nil, errShortRead
+	}
+	c.Lock()
+	if c.cs[k] == cl { // not invalidated while fetching
+		delete(c.cs, k)
+		if cl.err == nil {
+			c.mp[k] = c.l.PushFront(&block{k, cl.data})
+			c.size += n
+			c.reduce()
+		}
+	}
+	c.Unlock()
+	cl.wg.Done()
+	return cl.data, cl.err
+}
+
+func (c *Cache) invalidate(match func(string) bool) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for k, e := range c.mp {
+		if match(k.name) {
+			c.size -= int64(len(e.Value.(*block).data))
+			c.l.Remove(e)
+			delete(c.mp, k)
+		}
+	}
+	for k := range c.cs {
+		if match(k.name) {
+			delete(c.cs, k)
+		}
+	}
+	for name := range c.seq {
+		if match(name) {
+			delete(c.seq, name)
+		}
+	}
+}
+
+func (c *Cache) reduce() {
+	for e := c.l.Back(); e != nil && c.size > c.limit; e = c.l.Back() {
+		b := e.Value.(*block)
+		c.size -= int64(len(b.data))
+		c.l.Remove(e)
+		delete(c.mp, b.k)
+	}
+}
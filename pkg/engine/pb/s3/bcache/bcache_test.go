@@ -0,0 +1,98 @@
+package bcache
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	var mu sync.Mutex
+	var n int
+	obj := make([]byte, 1000)
+	for i := range obj {
+		obj[i] = byte(i)
+	}
+	fetch := func(off, size int64) ([]byte, error) {
+		mu.Lock()
+		n++
+		mu.Unlock()
+		return obj[off : off+size], nil
+	}
+	c := New(100, 300, 0)
+	for i := 0; i < 2; i++ {
+		p := make([]byte, 150)
+		if m, err := c.ReadAt("a", int64(len(obj)), p, 50, fetch); err != nil || m != 150 {
+			t.Fatalf("read: %v %v", m, err)
+		}
+		if !bytes.Equal(p, obj[50:200]) {
+			t.Fatal("unexpected data")
+		}
+	}
+	if n != 2 {
+		t.Fatalf("%v fetches", n)
+	}
+	p := make([]byte, 100)
+	if m, err := c.ReadAt("a", int64(len(obj)), p, 950, fetch); err != nil || m != 50 {
+		t.Fatalf("read: %v %v", m, err)
+	}
+	if c.Size() > 300 {
+		t.Fatalf("size: %v", c.Size())
+	}
+	c.Invalidate("a")
+	if c.Size() != 0 {
+		t.Fatalf("size: %v", c.Size())
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	var mu sync.Mutex
+	fetched := make(map[int64]bool)
+	fetch := func(off, size int64) ([]byte, error) {
+		mu.Lock()
+		fetched[off] = true
+		mu.Unlock()
+		return make([]byte, size), nil
+	}
+	c := New(100, 1<<20, 2)
+	p := make([]byte, 100)
+	for off := int64(0); off < 200; off += 100 {
+		if _, err := c.ReadAt("a", 1000, p, off, fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		ok := fetched[200] && fetched[300]
+		mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no readahead")
+}
+
+func TestReadaheadBound(t *testing.T) {
+	gate := make(chan struct{})
+	defer close(gate)
+	fetch := func(off, size int64) ([]byte, error) {
+		if off >= 200 { // readahead blocks
+			<-gate
+		}
+		return make([]byte, size), nil
+	}
+	c := New(100, 1<<20, 2)
+	p := make([]byte, 100)
+	for _, name := range []string{"a", "b", "c"} {
+		for off := int64(0); off < 200; off += 100 {
+			if _, err := c.ReadAt(name, 1000, p, off, fetch); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := len(c.ras); n != 2 {
+		t.Fatalf("%v readaheads in flight", n)
+	}
+}
@@ -0,0 +1,49 @@
+package bcache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+const (
+	DefaultBlockSize = 64 << 10
+	DefaultReadahead = 4 // blocks prefetched by sequential reads
+)
+
+var errShortRead = errors.New("short read")
+
+// Fetch reads n bytes of an object at off
+type Fetch func(off, n int64) ([]byte, error)
+
+// Cache is a lru cache of fixed size blocks of remote objects, a block is
+// keyed by the object and its aligned offset.
+type Cache struct {
+	sync.Mutex
+	bsize int64
+	limit int64
+	size  int64
+	ra    int64
+	ras   chan struct{} // bounds the readaheads in flight
+	l     *list.List
+	mp    map[key]*list.Element
+	cs    map[key]*call
+	seq   map[string]int64 // object -> next block of a sequential read
+}
+
+type key struct {
+	name string
+	blk  int64
+}
+
+type block struct {
+	k    key
+	data []byte
+}
+
+// call is a fetch of a block in progress
+type call struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
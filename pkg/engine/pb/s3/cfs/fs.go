@@ -1,7 +1,6 @@
 package cfs
 
 import (
-	"container/list"
 	"errors"
 	"io/ioutil"
 	"os"
@@ -9,7 +8,12 @@ import (
 	"strings"
 )
 
-func New(limit int, dir string, usr interface{}, cbk CallBack) (*fs, error) {
+// New opens the cache in dir, a nil policy means the TwoQueue policy and
+// the rules are followed by DefaultRules.
+func New(limit int, dir string, pol Policy, rules []Rule, usr interface{}, cbk CallBack) (*fs, error) {
+	if pol == nil {
+		pol, _ = NewPolicy(TwoQueue, limit)
+	}
 	if err := os.MkdirAll(dir, os.FileMode(0774)); err != nil {
 		return nil, err
 	}
@@ -18,11 +22,17 @@ func New(limit int, dir string, usr interface{}, cbk CallBack) (*fs, error) {
 		cbk:   cbk,
 		dir:   dir,
 		limit: limit,
+		pol:   pol,
+		rules: append(append([]Rule{}, rules...), DefaultRules...),
 		mp:    make(map[string]*file),
-		hq:    &queue{new(list.List)},
-		cq:    &queue{new(list.List)},
 	}
+	jnl, err := openJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.jnl = jnl
 	if err := c.load(dir); err != nil {
+		jnl.close()
 		return nil, err
 	}
 	return c, nil
@@ -30,80 +40,141 @@ func New(limit int, dir string, usr interface{}, cbk CallBack) (*fs, error) {
 
 func (c *fs) Close() error {
 	c.Lock()
-	defer c.Unlock()
+	fs := make([]*file, 0, len(c.mp))
 	for _, f := range c.mp {
+		fs = append(fs, f)
+	}
+	c.Unlock()
+	for _, f := range fs {
+		f.mu.Lock()
+		if f.removed {
+			f.mu.Unlock()
+			continue
+		}
 		if len(f.buf) > 0 {
 			f.write(f.buf)
+			f.buf = f.buf[:0]
 		}
 		if f.fi != nil {
 			f.fi.Close()
 			f.fi = nil
 		}
-		if f.dirty {
-			c.cbk(c.usr, f.path, f.rowpath, f.size)
+		c.Lock()
+		if f.dirty && c.mp[f.rowpath] == f {
+			c.cbk(c.usr, f.path, f.rowpath, f.size, f.gen)
+			f.dirty = false
 		}
+		c.Unlock()
+		f.mu.Unlock()
 	}
-	return nil
+	c.Lock()
+	defer c.Unlock()
+	return c.jnl.close()
 }
 
-func (c *fs) IsExist(path string) (int64, bool) {
+// Clean compares the generation, which changes with the contents and the
+// path, and the size, which also counts the writes in progress.
+func (c *fs) Clean(path string, size int, gen uint64) error {
+	c.Lock()
+	f, ok := c.mp[path]
+	if ok && (f.gen != gen || f.used != size) {
+		c.Unlock()
+		return nil
+	}
+	bypass := ok && f.mode&Bypass != 0
+	if ok {
+		f.dirty = false
+		if bypass {
+			c.remove(f)
+		}
+	}
+	err := c.jnl.clean(path)
+	c.Unlock()
+	if bypass {
+		c.drop(f, true)
+	}
+	return err
+}
+
+func (c *fs) Sync(path string) (error, bool) {
+	f := c.lock(path, false)
+	if f == nil {
+		return nil, false
+	}
+	defer f.mu.Unlock()
+	if len(f.buf) > 0 {
+		if err := f.write(f.buf); err != nil {
+			return err, true
+		}
+		f.buf = f.buf[:0]
+	}
+	if f.fi == nil {
+		fi, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, os.FileMode(0664))
+		if err != nil {
+			return err, true
+		}
+		f.fi = fi
+	}
+	return f.fi.Sync(), true
+}
+
+func (c *fs) Version(path string) (int, uint64, bool) {
+	f := c.lock(path, true)
+	if f == nil {
+		return -1, 0, false
+	}
+	defer f.mu.RUnlock()
 	c.Lock()
 	defer c.Unlock()
-	if f, ok := c.mp[path]; ok {
-		return int64(f.size + len(f.buf)), ok
+	return f.len(), f.gen, true
+}
+
+func (c *fs) IsExist(path string) (int64, bool) {
+	f := c.lock(path, true)
+	if f == nil {
+		return -1, false
 	}
-	return -1, false
+	defer f.mu.RUnlock()
+	return int64(f.len()), true
 }
 
 func (c *fs) Remove(path string) (error, bool) {
-	var f *file
-	var ok bool
-
 	c.Lock()
-	if f, ok = c.mp[path]; ok {
-		if f.fi != nil {
-			f.fi.Close()
-			f.fi = nil
-		}
-		if f.h != nil {
-			c.hq.l.Remove(f.h)
-		}
-		if f.c != nil {
-			c.cq.l.Remove(f.c)
-		}
-		c.size -= f.size
-		delete(c.mp, path)
-		c.cbk(c.usr, f.path, f.rowpath, -1)
+	f, ok := c.mp[path]
+	if ok {
+		c.remove(f)
 	}
+	err := c.jnl.clean(path)
 	c.Unlock()
-	return nil, ok
+	if ok {
+		c.drop(f, true)
+	}
+	return err, ok
 }
 
 func (c *fs) RemoveAll(path string) error {
-	fs, err := c.List(path)
-	if err != nil {
-		return err
-	}
+	var fs []*file
+
 	c.Lock()
-	for i, j := 0, len(fs); i < j; i++ {
-		if f, ok := c.mp[path+"/"+fs[i]]; ok {
-			if f.fi != nil {
-				f.fi.Close()
-				f.fi = nil
-			}
-			if f.h != nil {
-				c.hq.l.Remove(f.h)
-			}
-			if f.c != nil {
-				c.cq.l.Remove(f.c)
+	for name, f := range c.mp {
+		if name == path || strings.HasPrefix(name, path+"/") {
+			c.remove(f)
+			fs = append(fs, f)
+		}
+	}
+	var err error
+	for name := range c.jnl.mp {
+		if name == path || strings.HasPrefix(name, path+"/") {
+			if err = c.jnl.clean(name); err != nil {
+				break
 			}
-			c.size -= f.size
-			delete(c.mp, path+"/"+fs[i])
-			c.cbk(c.usr, f.path, f.rowpath, -1)
 		}
 	}
 	c.Unlock()
-	return nil
+	for _, f := range fs {
+		c.drop(f, true)
+	}
+	return err
 }
 
 func (c *fs) List(path string) ([]string, error) {
@@ -111,84 +182,347 @@ func (c *fs) List(path string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	return f.Readdirnames(-1)
 }
 
 func (c *fs) Link(oldname, newname string) (error, bool) {
-	var ok bool
-	var f *file
-	var err error
-
-	c.Lock()
-	if f, ok = c.mp[oldname]; ok {
-		if len(f.buf) > 0 {
-			if err := f.write(f.buf); err != nil {
-				c.Unlock()
-				return err, ok
-			}
-			f.buf = f.buf[:0]
-		}
-		if err = os.Link(c.dir+"/"+oldname, c.dir+"/"+newname); err == nil {
-			if f.fi != nil {
-				f.fi.Close()
-				f.fi = nil
-			}
-			nf := &file{size: f.size, dirty: true, path: c.dir + "/" + newname, rowpath: newname}
-			c.mp[newname] = nf
-			c.set(nf)
+	f := c.lock(oldname, false)
+	if f == nil {
+		return nil, false
+	}
+	if len(f.buf) > 0 {
+		if err := f.write(f.buf); err != nil {
+			f.mu.Unlock()
+			return err, true
 		}
+		f.buf = f.buf[:0]
+	}
+	if err := os.MkdirAll(filepath.Dir(c.dir+"/"+newname), os.FileMode(0774)); err != nil {
+		f.mu.Unlock()
+		return err, true
+	}
+	if err := os.Link(f.path, c.dir+"/"+newname); err != nil {
+		f.mu.Unlock()
+		return err, true
+	}
+	if f.fi != nil {
+		f.fi.Close()
+		f.fi = nil
 	}
+	size := f.size
+	f.mu.Unlock()
+	nf := &file{mode: c.mode(newname), size: size, used: size, dirty: true, path: c.dir + "/" + newname, rowpath: newname}
+	nf.mu.Lock() // held until the mark is synced
+	c.Lock()
+	old, ok := c.mp[newname]
+	if ok {
+		c.remove(old)
+	}
+	c.mp[newname] = nf
+	c.touch(nf)
+	vs := c.set(nf)
+	c.jnl.dirty(newname)
 	c.Unlock()
-	return err, ok
+	if ok {
+		c.drop(old, false)
+	}
+	err := c.jnl.record(newname)
+	nf.mu.Unlock()
+	c.writeBack(vs)
+	return err, true
 }
 
+// Rename moves the entry of the file to newname before its cache file is
+// renamed, the lookups of newname wait for the rename under the lock of
+// the file.
 func (c *fs) Rename(oldname, newname string) (error, bool) {
-	var ok bool
-	var f *file
-	var err error
-
+	f := c.lock(oldname, false)
+	if f == nil {
+		return nil, false
+	}
+	defer f.mu.Unlock()
 	c.Lock()
-	if f, ok = c.mp[oldname]; ok {
-		if err = os.Rename(c.dir+"/"+oldname, c.dir+"/"+newname); err == nil {
-			if f.fi != nil {
-				f.fi.Close()
-				f.fi = nil
-			}
-			f.rowpath = newname
-			f.path = c.dir + "/" + newname
-			c.mp[newname] = f
-			delete(c.mp, oldname)
-			c.get(f, 0)
+	if c.mp[oldname] != f { // renamed while waiting for the lock
+		c.Unlock()
+		return nil, false
+	}
+	if oldname == newname {
+		c.Unlock()
+		return nil, true
+	}
+	old, ok := c.mp[newname]
+	if ok {
+		c.remove(old)
+	}
+	f.rowpath = newname
+	f.mode = c.mode(newname)
+	c.mp[newname] = f
+	delete(c.mp, oldname)
+	c.pol.Rename(oldname, newname)
+	c.get(f, 0)
+	c.touch(f)
+	moved := c.jnl.isDirty(oldname) // the write back of oldname may be lost
+	if moved {
+		f.dirty = true
+		c.jnl.dirty(newname)
+	}
+	c.Unlock()
+	if ok {
+		c.drop(old, false) // its writes must not reach the renamed file
+	}
+	if moved {
+		// oldname is cleaned once the mark of newname is synced
+		err := c.jnl.record(newname)
+		c.Lock()
+		if _, ok := c.mp[oldname]; !ok && err == nil {
+			err = c.jnl.clean(oldname)
 		}
+		c.Unlock()
+		if err != nil {
+			return err, true
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(c.dir+"/"+newname), os.FileMode(0774)); err != nil {
+		return err, true
+	}
+	if err := os.Rename(f.path, c.dir+"/"+newname); err != nil {
+		return err, true
 	}
+	if f.fi != nil {
+		f.fi.Close()
+		f.fi = nil
+	}
+	c.Lock()
+	f.path = c.dir + "/" + newname
 	c.Unlock()
-	return err, ok
+	return nil, true
 }
 
 func (c *fs) Create(path string) error {
-	f := &file{dirty: true, path: c.dir + "/" + path, rowpath: path}
-	if err := c.newFile(f.path); err != nil {
-		return err
-	}
+	f := &file{mode: c.mode(path), dirty: true, path: c.dir + "/" + path, rowpath: path}
+	f.mu.Lock() // held until the cache file is created
 	c.Lock()
+	old, ok := c.mp[path]
+	if ok {
+		c.remove(old)
+	}
 	c.mp[path] = f
-	c.set(f)
+	c.touch(f)
+	vs := c.set(f)
+	c.jnl.dirty(path)
 	c.Unlock()
-	return nil
+	if ok {
+		c.drop(old, false)
+	}
+	err := c.jnl.record(path) // even if marked, the mark may not be synced yet
+	if err == nil {
+		err = c.newFile(f.path)
+	}
+	if err != nil {
+		c.discard(f)
+	}
+	f.mu.Unlock()
+	c.writeBack(vs)
+	return err
 }
 
+// Read reads the cache file under its read lock, reads of a file
+// proceed in parallel with each other and with other files.
 func (c *fs) Read(path string, off int64, length int) ([]byte, error, bool) {
+	for {
+		c.Lock()
+		f, ok := c.mp[path]
+		if !ok {
+			c.misses++
+			c.Unlock()
+			return nil, nil, false
+		}
+		c.hits++
+		c.get(f, 0)
+		c.Unlock()
+		f.mu.RLock()
+		if !f.removed {
+			defer f.mu.RUnlock()
+			data, err := f.readFile(off, length)
+			return data, err, true
+		}
+		f.mu.RUnlock()
+	}
+}
+
+func (c *fs) Fill(path string, data []byte) error {
+	f := &file{mode: c.mode(path), used: len(data), path: c.dir + "/" + path, rowpath: path}
+	f.mu.Lock() // held until the data is written
+	c.Lock()
+	if _, ok := c.mp[path]; ok || len(data) >= c.limit {
+		c.Unlock()
+		f.mu.Unlock()
+		return nil
+	}
+	c.mp[path] = f
+	c.touch(f)
+	vs := c.set(f) // evicts for the data like the writes of created files
+	c.Unlock()
+	err := c.newFile(f.path)
+	if err == nil {
+		err = f.write(data)
+	}
+	if f.fi != nil {
+		f.fi.Close()
+		f.fi = nil
+	}
+	if err != nil {
+		c.discard(f)
+	}
+	f.mu.Unlock()
+	c.writeBack(vs)
+	return err
+}
+
+func (c *fs) Replay() {
 	c.Lock()
-	data, err, ok := c.readFile(path, off, length)
+	paths := c.replay
+	c.replay = nil
 	c.Unlock()
-	return data, err, ok
+	for _, path := range paths {
+		f := c.lock(path, true)
+		if f == nil {
+			continue
+		}
+		c.Lock()
+		if f.dirty && c.mp[path] == f {
+			c.cbk(c.usr, f.path, f.rowpath, f.size, f.gen)
+			f.dirty = false
+		}
+		c.Unlock()
+		f.mu.RUnlock()
+	}
+	c.Lock()
+	defer c.Unlock()
+	for path := range c.jnl.mp { // the cache files are lost
+		if _, ok := c.mp[path]; !ok {
+			c.jnl.clean(path)
+		}
+	}
+}
+
+func (c *fs) Mode(path string) int {
+	c.Lock()
+	defer c.Unlock()
+	if f, ok := c.mp[path]; ok {
+		return f.mode
+	}
+	return c.mode(path)
 }
 
+func (c *fs) Pin(path string, pin bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	f, ok := c.mp[path]
+	if !ok {
+		return false
+	}
+	if pin {
+		f.mode |= Pin
+	} else {
+		f.mode &^= Pin
+	}
+	return true
+}
+
+// Write marks the file dirty under the lock of the file, the writes of
+// the file wait until the mark is synced to the journal.
 func (c *fs) Write(path string, data []byte) (error, bool) {
+	for {
+		f := c.lock(path, false)
+		if f == nil {
+			return nil, false
+		}
+		c.Lock()
+		if c.mp[path] != f { // replaced while waiting for the lock
+			c.Unlock()
+			f.mu.Unlock()
+			continue
+		}
+		rec := c.jnl.dirty(path)
+		f.dirty = true
+		c.get(f, len(data))
+		c.touch(f)
+		c.Unlock()
+		defer f.mu.Unlock()
+		if rec {
+			if err := c.jnl.record(path); err != nil {
+				return err, true
+			}
+		}
+		return f.writeFile(data), true
+	}
+}
+
+// lock looks up path and returns the file locked, or nil. The lock of the
+// file is taken once the lock of the cache is released, files dropped
+// meanwhile are looked up again.
+func (c *fs) lock(path string, read bool) *file {
+	for {
+		c.Lock()
+		f, ok := c.mp[path]
+		c.Unlock()
+		if !ok {
+			return nil
+		}
+		if read {
+			f.mu.RLock()
+		} else {
+			f.mu.Lock()
+		}
+		if !f.removed {
+			return f
+		}
+		if read {
+			f.mu.RUnlock()
+		} else {
+			f.mu.Unlock()
+		}
+	}
+}
+
+// remove removes f from the cache, it is closed by drop once the lock of
+// the cache is released.
+func (c *fs) remove(f *file) {
+	if !f.evicted {
+		c.size -= f.used
+		c.pol.Remove(f.rowpath)
+	}
+	delete(c.mp, f.rowpath)
+}
+
+// drop closes f removed from the cache once the reads and writes in
+// progress are done, and drops its cache file if unlink is set and the
+// path is not taken again.
+func (c *fs) drop(f *file, unlink bool) {
+	f.mu.Lock()
+	f.close()
+	f.mu.Unlock()
+	if !unlink {
+		return
+	}
 	c.Lock()
-	err, ok := c.writeFile(path, data)
+	if _, ok := c.mp[f.rowpath]; !ok {
+		c.cbk(c.usr, f.path, f.rowpath, -1, 0)
+	}
+	c.Unlock()
+}
+
+// discard drops f whose cache file could not be written, f is locked
+func (c *fs) discard(f *file) {
+	f.close()
+	c.Lock()
+	if c.mp[f.rowpath] == f {
+		c.remove(f)
+		os.Remove(f.path)
+	}
 	c.Unlock()
-	return err, ok
 }
 
 func (c *fs) load(dir string) error {
@@ -210,129 +544,134 @@ func (c *fs) load(dir string) error {
 			if err := c.load(dir + "/" + fp.Name()); err != nil {
 				return err
 			}
+			continue
 		}
 		path, _ := filepath.Rel(c.dir, dir+"/"+fp.Name())
-		f := &file{size: int(fp.Size()), dirty: false, path: c.dir + "/" + path, rowpath: path}
+		if path == JournalName || path == JournalName+".tmp" {
+			continue
+		}
+		size := int(fp.Size())
+		f := &file{mode: c.mode(path), size: size, used: size, dirty: c.jnl.isDirty(path), path: c.dir + "/" + path, rowpath: path}
+		if f.dirty {
+			c.replay = append(c.replay, path)
+		}
 		c.mp[path] = f
-		c.set(f)
+		c.touch(f)
+		c.writeBack(c.set(f))
 	}
 	return nil
 }
 
-func (c *fs) readFile(path string, off int64, length int) ([]byte, error, bool) {
-	if f, ok := c.mp[path]; ok {
-		c.get(f, 0)
-		if data, err := f.readFile(off, length); err != nil {
-			return nil, err, true
-		} else {
-			return data, nil, true
-		}
-	}
-	return nil, nil, false
-}
-
-func (c *fs) writeFile(path string, data []byte) (error, bool) {
-	if f, ok := c.mp[path]; ok {
-		c.get(f, len(data))
-		if err := f.writeFile(data); err != nil {
-			return err, ok
-		}
-		return nil, ok
-	}
-	return nil, false
+// touch gives f a new generation, the generations are unique in the cache
+// so that a file renamed over another one never takes its generation.
+func (c *fs) touch(f *file) {
+	c.gen++
+	f.gen = c.gen
 }
 
 func (c *fs) get(f *file, size int) {
-	c.size += size
-	switch f.typ {
-	case H:
-		isBack := f.h.Next() == nil
-		c.hq.l.MoveToFront(f.h)
-		if isBack {
-			c.reduce()
-		}
-		return
-	}
-	switch {
-	case f.h == nil:
-		c.cq.l.MoveToFront(f.c)
-		f.h = c.hq.l.PushFront(f)
-	default:
-		f.typ = H
-		c.cq.l.Remove(f.c)
-		f.c = nil
-		c.hq.l.MoveToFront(f.h)
-		c.exchange()
-		c.reduce()
+	f.used += size
+	if !f.evicted {
+		c.size += size
+		c.pol.Access(f.rowpath, size)
 	}
 }
 
-func (c *fs) set(f *file) {
-	c.size += f.size
-	switch {
-	case c.size < c.limit-c.limit/ColdMultiples:
-		f.typ = H
-		f.h = c.hq.l.PushFront(f)
-	case c.size < c.limit:
-		f.typ = C
-		f.c = c.cq.l.PushFront(f)
-	default:
-		c.release()
-		f.typ = C
-		f.c = c.cq.l.PushFront(f)
+func (c *fs) set(f *file) []victim {
+	var vs []victim
+
+	c.size += f.used
+	if c.size >= c.limit {
+		vs = c.release()
 	}
+	c.pol.Add(f.rowpath, f.used)
+	return vs
 }
 
-func (c *fs) release() {
-	for e := c.cq.l.Back(); e != nil; e = e.Prev() {
-		f := e.Value.(*file)
-		if f.dirty {
-			if len(f.buf) > 0 {
-				f.write(f.buf)
+// release chooses files in the order of the policy until the cache is
+// below its limit, they are written back by writeBack once the lock of
+// the cache is released. Pinned files are written back but kept.
+func (c *fs) release() []victim {
+	var vs []victim
+
+	c.pol.Evict(func(path string) (bool, bool) {
+		f := c.mp[path]
+		if f.mode&Pin != 0 {
+			if f.dirty {
+				vs = append(vs, victim{f, false})
 			}
-			c.cbk(c.usr, f.path, f.rowpath, f.size)
-			f.dirty = false
+			return false, true
 		}
-		if isSST(f.rowpath) {
-			if f.fi != nil {
-				f.fi.Close()
-			}
-			f.c = nil
-			c.cq.l.Remove(e)
-			if f.h != nil {
-				f.h = nil
-				c.hq.l.Remove(e)
+		vs = append(vs, victim{f, true})
+		f.evicted = true
+		c.size -= f.used
+		c.evictions++
+		return true, c.size >= c.limit
+	})
+	return vs
+}
+
+// writeBack flushes the files chosen by release and calls back for the
+// dirty ones. Evicted files stay in the cache until then, so that the
+// lookups which find them dropped see their write back queued.
+func (c *fs) writeBack(vs []victim) {
+	for _, v := range vs {
+		f := v.f
+		f.mu.Lock() // waits for the reads and writes in progress
+		if f.removed {
+			f.mu.Unlock()
+			continue
+		}
+		if len(f.buf) > 0 {
+			f.write(f.buf)
+			f.buf = f.buf[:0]
+		}
+		if v.evict {
+			f.close()
+		}
+		c.Lock()
+		if c.mp[f.rowpath] == f {
+			switch {
+			case f.dirty:
+				c.cbk(c.usr, f.path, f.rowpath, f.size, f.gen)
+				f.dirty = false
+			case v.evict: // the object is in the store, drop the cache file
+				c.cbk(c.usr, f.path, f.rowpath, -1, 0)
 			}
-			c.size -= f.size
-			delete(c.mp, f.rowpath)
-			if c.size < c.limit {
-				return
+			if v.evict {
+				delete(c.mp, f.rowpath)
 			}
 		}
+		c.Unlock()
+		f.mu.Unlock()
 	}
 }
 
-func (c *fs) reduce() {
-	for e := c.hq.l.Back(); e != nil; e = c.hq.l.Back() {
-		f := e.Value.(*file)
-		if f.typ == H {
-			return
-		}
-		f.h = nil
-		c.hq.l.Remove(e)
+func (c *fs) SetLimit(limit int) {
+	var vs []victim
+
+	c.Lock()
+	c.limit = limit
+	c.pol.Resize(limit)
+	if c.size >= c.limit {
+		vs = c.release()
 	}
+	c.Unlock()
+	c.writeBack(vs)
 }
 
-func (c *fs) exchange() {
-	if e := c.hq.l.Back(); e != nil {
-		f := e.Value.(*file)
-		if f.typ != H {
-			return
-		}
-		c.hq.l.Remove(e)
-		f.h = nil
-		f.typ = C
-		f.c = c.cq.l.PushFront(f)
+func (c *fs) Stats() Stats {
+	c.Lock()
+	defer c.Unlock()
+	return Stats{
+		Policy:    c.pol.Name(),
+		Files:     len(c.mp),
+		Size:      c.size,
+		Limit:     c.limit,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Details:   c.pol.Stats(),
 	}
 }
 
@@ -381,7 +720,6 @@ func (f *file) readFile(off int64, length int) ([]byte, error) {
 }
 
 func (f *file) writeFile(data []byte) error {
-	f.dirty = true
 	f.buf = append(f.buf, data...)
 	if len(f.buf) >= FlushSize {
 		if err := f.write(f.buf); err != nil {
@@ -407,7 +745,28 @@ func (f *file) write(data []byte) error {
 	return nil
 }
 
-func isSST(path string) bool {
-	s := strings.Split(path, ".")
-	return strings.Compare(s[len(s)-1], "sst") == 0
+// close closes the file dropped from the cache, the lookups which found it
+// before look up its path again.
+func (f *file) close() {
+	if f.fi != nil {
+		f.fi.Close()
+		f.fi = nil
+	}
+	f.removed = true
+}
+
+// len returns the size of the file including its buffer
+func (f *file) len() int {
+	return f.size + len(f.buf)
+}
+
+// mode returns the mode of path by the rules
+func (c *fs) mode(path string) int {
+	name := filepath.Base(path)
+	for _, r := range c.rules {
+		if ok, _ := filepath.Match(r.Pattern, name); ok {
+			return r.Mode
+		}
+	}
+	return 0
 }
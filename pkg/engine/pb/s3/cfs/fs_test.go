@@ -0,0 +1,427 @@
+package cfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var names []string
+	gens := make(map[string]uint64)
+	cbk := func(_ interface{}, _, rowpath string, size int, gen uint64) {
+		if size >= 0 {
+			names = append(names, rowpath)
+			gens[rowpath] = gen
+		}
+	}
+	c, err := New(1<<30, dir, nil, nil, nil, cbk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db/a", "db/b"} {
+		if err := c.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		if err, _ := c.Write(name, make([]byte, FlushSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.jnl.close() // crash
+	if c, err = New(1<<30, dir, nil, nil, nil, cbk); err != nil {
+		t.Fatal(err)
+	}
+	if c.Replay(); len(names) != 2 {
+		t.Fatalf("dirty files: %v", names)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("dirty files: %v", names)
+	}
+	if c, err = New(1<<30, dir, nil, nil, nil, cbk); err != nil {
+		t.Fatal(err)
+	}
+	names = names[:0]
+	c.Close()
+	c.Clean("db/a", FlushSize, gens["db/a"]) // write back of db/a completes after close
+	if c, err = New(1<<30, dir, nil, nil, nil, cbk); err != nil {
+		t.Fatal(err)
+	}
+	names = names[:0]
+	c.Close()
+	if len(names) != 1 || names[0] != "db/b" {
+		t.Fatalf("dirty files: %v", names)
+	}
+}
+
+func TestCleanRenamed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := New(1<<20, dir, nil, nil, nil, func(interface{}, string, string, int, uint64) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, name := range []string{"db/CURRENT", "db/CURRENT.dbtmp"} {
+		if err := c.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		if err, _ := c.Write(name, []byte(name[3:7])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, gen, _ := c.Version("db/CURRENT") // the write back of CURRENT starts
+	if err, _ := c.Rename("db/CURRENT.dbtmp", "db/CURRENT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clean("db/CURRENT", size, gen); err != nil {
+		t.Fatal(err)
+	}
+	if !c.mp["db/CURRENT"].dirty || !c.jnl.isDirty("db/CURRENT") {
+		t.Fatal("file renamed over with the same size is clean")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	for _, name := range []string{TwoQueue, LRU, ARC, GDSF} {
+		t.Run(name, func(t *testing.T) { testConcurrency(t, name) })
+	}
+}
+
+func testConcurrency(t *testing.T, name string) {
+	pol, err := NewPolicy(name, 256<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var c *fs
+	var wg sync.WaitGroup
+	cbk := func(_ interface{}, path, rowpath string, size int, gen uint64) {
+		if size < 0 {
+			os.Remove(path)
+			return
+		}
+		wg.Add(1)
+		go func() { // write back
+			defer wg.Done()
+			c.Clean(rowpath, size, gen)
+		}()
+	}
+	if c, err = New(256<<10, dir, pol, nil, nil, cbk); err != nil {
+		t.Fatal(err)
+	}
+	var workers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		workers.Add(1)
+		go func(w int) {
+			defer workers.Done()
+			for i := 0; i < 200; i++ {
+				name := fmt.Sprintf("db%v/%06d.sst", w, i%16)
+				b := byte(w*31 + i)
+				if err := c.Create(name); err != nil {
+					t.Error(err)
+					return
+				}
+				for j := 0; j < 4; j++ {
+					if err, _ := c.Write(name, bytes.Repeat([]byte{b}, 4096)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if i%3 == 0 {
+					if err, _ := c.Sync(name); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				for j := 0; j < 8; j++ {
+					size, ok := c.IsExist(name)
+					if !ok {
+						break // evicted
+					}
+					off := int64(j * 1000)
+					data, err, ok := c.Read(name, off, int(size-off))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok && !bytes.Equal(data, bytes.Repeat([]byte{b}, int(size-off))) {
+						t.Errorf("%v: unexpected data", name)
+						return
+					}
+				}
+				if i%5 == 0 {
+					c.Remove(name)
+				}
+			}
+		}(w)
+	}
+	workers.Wait()
+	wg.Wait()
+	size := 0
+	for _, f := range c.mp {
+		size += f.len()
+	}
+	if size != c.size || c.pol.Len() != len(c.mp) {
+		t.Fatalf("size %v, expected %v", c.size, size)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := New(1<<20, dir, nil, nil, nil, func(interface{}, string, string, int, uint64) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, name := range []string{"db/a", "db/b"} {
+		if err := c.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		if err, _ := c.Write(name, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := c.mp["db/a"]
+	f.mu.Lock() // a sync of db/a in progress
+	read := make(chan struct{})
+	go func() {
+		c.Read("db/a", 0, 4)
+		close(read)
+	}()
+	defer func() {
+		f.mu.Unlock()
+		<-read
+	}()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		if err, _ := c.Write("db/b", []byte("data")); err != nil {
+			done <- err
+			return
+		}
+		if err := c.Create("db/c"); err != nil {
+			done <- err
+			return
+		}
+		err, _ := c.Rename("db/c", "db/d")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stalled by the lock of db/a")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	evict := func(p Policy, n int) []string {
+		var names []string
+		p.Evict(func(name string) (bool, bool) {
+			names = append(names, name)
+			return true, len(names) < n
+		})
+		return names
+	}
+	p, _ := NewPolicy(LRU, 100)
+	for _, name := range []string{"a", "b", "c"} {
+		p.Add(name, 10)
+	}
+	p.Access("a", 0)
+	p.Rename("b", "d")
+	if names := evict(p, 2); fmt.Sprint(names) != "[d c]" || p.Len() != 1 {
+		t.Fatalf("lru evicted %v", names)
+	}
+
+	p, _ = NewPolicy(GDSF, 100)
+	p.Add("big", 50)
+	p.Add("small", 5)
+	p.Add("hot", 50)
+	p.Access("hot", 0)
+	p.Access("hot", 0)
+	p.Add("written", 45)
+	p.Access("written", 5) // writes don't count
+	p.Access("written", 5)
+	if names := evict(p, 3); fmt.Sprint(names) != "[written big hot]" {
+		t.Fatalf("gdsf evicted %v", names)
+	}
+	if p.Stats()["clock"] == 0 {
+		t.Fatal("gdsf clock not advanced")
+	}
+
+	p, _ = NewPolicy(ARC, 40)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		p.Add(name, 10)
+	}
+	p.Access("a", 0) // a moves to t2, the files accessed once go first
+	if names := evict(p, 2); fmt.Sprint(names) != "[b c]" {
+		t.Fatalf("arc evicted %v", names)
+	}
+	p.Add("b", 10) // a hit in b1 grows the target of t1
+	if st := p.Stats(); st["ghost_hits"] != 1 || st["p"] != 10 || p.Len() != 3 {
+		t.Fatalf("arc stats %v", st)
+	}
+
+	if _, err := NewPolicy("fifo", 100); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cbk := func(_ interface{}, path, _ string, size int, _ uint64) {
+		if size < 0 {
+			os.Remove(path)
+		}
+	}
+	rules := []Rule{{"000001.sst", Pin}, {"*.log", Bypass}, {"MANIFEST-*", WriteThrough}}
+	pol, _ := NewPolicy(LRU, 64<<10)
+	c, err := New(64<<10, dir, pol, rules, nil, cbk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Mode("db/MANIFEST-000001") != WriteThrough || c.Mode("db/OPTIONS-000002") != Pin || c.Mode("db/000002.sst") != 0 {
+		t.Fatal("unexpected modes")
+	}
+	for i := 1; i <= 8; i++ {
+		name := fmt.Sprintf("db/%06d.sst", i)
+		if err := c.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		if err, _ := c.Write(name, make([]byte, 16<<10)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 && !c.Pin(name, true) {
+			t.Fatalf("%v not found", name)
+		}
+	}
+	for i, exist := range []bool{true, true, false} {
+		if _, ok := c.IsExist(fmt.Sprintf("db/%06d.sst", i+1)); ok != exist {
+			t.Fatalf("%v: exist %v, expected %v", i+1, ok, exist)
+		}
+	}
+	if err := c.Create("db/000009.log"); err != nil {
+		t.Fatal(err)
+	}
+	_, gen, _ := c.Version("db/000009.log")
+	if err := c.Clean("db/000009.log", 0, gen); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.IsExist("db/000009.log"); ok {
+		t.Fatal("bypassed file is cached")
+	}
+	if err := c.Fill("db/000003.sst", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err, ok := c.Read("db/000003.sst", 0, 3); err != nil || !ok || string(data) != "abc" {
+		t.Fatalf("read %q: %v, %v", data, err, ok)
+	}
+	if c.mp["db/000003.sst"].dirty {
+		t.Fatal("filled file is dirty")
+	}
+}
+
+func TestFill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cbk := func(_ interface{}, path, _ string, size int, _ uint64) {
+		if size < 0 {
+			os.Remove(path)
+		}
+	}
+	pol, _ := NewPolicy(LRU, 64<<10)
+	c, err := New(64<<10, dir, pol, nil, nil, cbk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 8; i++ {
+		if err := c.Fill(fmt.Sprintf("db/%06d.sst", i), make([]byte, 16<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := c.Stats(); st.Size >= 64<<10 || st.Evictions != 5 || st.Files != 3 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if _, ok := c.IsExist("db/000000.sst"); ok {
+		t.Fatal("first filled file not evicted")
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	for _, name := range []string{TwoQueue, ARC} {
+		t.Run(name, func(t *testing.T) { testSetLimit(t, name) })
+	}
+}
+
+func testSetLimit(t *testing.T, name string) {
+	dir, err := ioutil.TempDir("", "cfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cbk := func(_ interface{}, path, _ string, size int, _ uint64) {
+		if size < 0 {
+			os.Remove(path)
+		}
+	}
+	pol, _ := NewPolicy(name, 1<<20)
+	c, err := New(1<<20, dir, pol, nil, nil, cbk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("db/%06d.sst", i)
+		if err := c.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		if err, _ := c.Write(name, make([]byte, 16<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.SetLimit(48 << 10)
+	if st := c.Stats(); st.Size >= 48<<10 || st.Evictions != 6 || st.Limit != 48<<10 || st.Details["p"] > 48<<10 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	c.SetLimit(1 << 20)
+	if st := c.Stats(); st.Files != 2 || st.Limit != 1<<20 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,159 @@
+package cfs
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// openJournal replays the journal in dir and rewrites it with the files
+// which are still dirty.
+func openJournal(dir string) (*journal, error) {
+	j := &journal{path: filepath.Join(dir, JournalName), mp: make(map[string]struct{})}
+	if fi, err := os.Open(j.path); err == nil {
+		s := bufio.NewScanner(fi)
+		for s.Scan() {
+			line := s.Text()
+			if len(line) < 3 {
+				continue // torn write
+			}
+			switch line[0] {
+			case JournalDirty:
+				j.mp[line[2:]] = struct{}{}
+			case JournalClean:
+				delete(j.mp, line[2:])
+			}
+		}
+		fi.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) isDirty(path string) bool {
+	_, ok := j.mp[path]
+	return ok
+}
+
+// dirty marks that path has data which is not written back, it reports
+// whether the mark is new and its record must be written by record.
+func (j *journal) dirty(path string) bool {
+	if _, ok := j.mp[path]; ok {
+		return false
+	}
+	j.mp[path] = struct{}{}
+	return true
+}
+
+// record writes the dirty record of path and syncs it to disk. It runs
+// without the lock of the cache, under the lock of the file whose data
+// is not written back, the sync is done without the lock of the journal.
+func (j *journal) record(path string) error {
+	j.mu.Lock()
+	fi := j.fi
+	if fi == nil {
+		j.mu.Unlock()
+		return j.reopen(JournalDirty, path)
+	}
+	_, err := fi.WriteString(string(JournalDirty) + " " + path + "\n")
+	j.n++
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// fi is closed once a rewrite replaced it, the rewrite synced the mark
+	if err := fi.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// clean records that path has been written back or removed
+func (j *journal) clean(path string) error {
+	if _, ok := j.mp[path]; !ok {
+		return nil
+	}
+	delete(j.mp, path)
+	return j.append(JournalClean, path)
+}
+
+// append writes a record under the lock of the cache, which guards mp
+// for the rewrite.
+func (j *journal) append(typ byte, path string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.fi == nil {
+		return j.reopen(typ, path)
+	}
+	if j.n >= JournalCompactSize && j.n >= 2*len(j.mp) {
+		return j.rewrite()
+	}
+	if _, err := j.fi.WriteString(string(typ) + " " + path + "\n"); err != nil {
+		return err
+	}
+	j.n++
+	return nil
+}
+
+// reopen appends a record to the closed journal, write backs may still
+// complete after close.
+func (j *journal) reopen(typ byte, path string) error {
+	fi, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, os.FileMode(0664))
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	_, err = fi.WriteString(string(typ) + " " + path + "\n")
+	return err
+}
+
+// rewrite replaces the journal with the records of the dirty files
+func (j *journal) rewrite() error {
+	var buf strings.Builder
+
+	for path := range j.mp {
+		buf.WriteString(string(JournalDirty) + " " + path + "\n")
+	}
+	tmp := j.path + ".tmp"
+	fi, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0664))
+	if err != nil {
+		return err
+	}
+	if _, err := fi.WriteString(buf.String()); err != nil {
+		fi.Close()
+		return err
+	}
+	if err := fi.Sync(); err != nil {
+		fi.Close()
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		fi.Close()
+		return err
+	}
+	if j.fi != nil {
+		j.fi.Close()
+	}
+	j.fi, j.n = fi, len(j.mp)
+	return nil
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.fi == nil {
+		return nil
+	}
+	err := j.fi.Close()
+	j.fi = nil
+	return err
+}
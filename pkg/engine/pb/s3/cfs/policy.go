@@ -0,0 +1,490 @@
+package cfs
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// NewPolicy returns the eviction policy of name for a cache of limit bytes,
+// an empty name means TwoQueue.
+func NewPolicy(name string, limit int) (Policy, error) {
+	switch name {
+	case "", TwoQueue:
+		return &twoQueue{limit: limit, hq: list.New(), cq: list.New(), mp: make(map[string]*qEntry)}, nil
+	case LRU:
+		return &lru{l: list.New(), mp: make(map[string]*list.Element)}, nil
+	case ARC:
+		return &arc{c: limit, t1: newARCList(), t2: newARCList(), b1: newARCList(), b2: newARCList(),
+			mp: make(map[string]*arcEntry)}, nil
+	case GDSF:
+		return &gdsf{mp: make(map[string]*gdsfEntry)}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy '%s'", name)
+}
+
+// twoQueue keeps the files in a hot queue until the cache is nearly full,
+// files in the cold queue are promoted to the hot queue on their second
+// access and only the cold queue is evicted.
+func (q *twoQueue) Name() string {
+	return TwoQueue
+}
+
+func (q *twoQueue) Add(name string, size int) {
+	q.size += size
+	e := &qEntry{name: name, size: size}
+	q.mp[name] = e
+	if q.size < q.limit-q.limit/ColdMultiples {
+		e.typ = H
+		e.h = q.hq.PushFront(e)
+	} else {
+		e.typ = C
+		e.c = q.cq.PushFront(e)
+	}
+}
+
+func (q *twoQueue) Access(name string, n int) {
+	e, ok := q.mp[name]
+	if !ok {
+		return
+	}
+	q.size += n
+	e.size += n
+	switch e.typ {
+	case H:
+		isBack := e.h.Next() == nil
+		q.hq.MoveToFront(e.h)
+		if isBack {
+			q.reduce()
+		}
+		return
+	}
+	switch {
+	case e.h == nil:
+		q.cq.MoveToFront(e.c)
+		e.h = q.hq.PushFront(e)
+	default:
+		e.typ = H
+		q.cq.Remove(e.c)
+		e.c = nil
+		q.hq.MoveToFront(e.h)
+		q.exchange()
+		q.reduce()
+	}
+}
+
+func (q *twoQueue) Remove(name string) {
+	if e, ok := q.mp[name]; ok {
+		q.remove(e)
+	}
+}
+
+func (q *twoQueue) Rename(oldname, newname string) {
+	if e, ok := q.mp[oldname]; ok {
+		delete(q.mp, oldname)
+		e.name = newname
+		q.mp[newname] = e
+	}
+}
+
+func (q *twoQueue) Evict(fn func(string) (bool, bool)) {
+	for le := q.cq.Back(); le != nil; {
+		prev := le.Prev()
+		e := le.Value.(*qEntry)
+		drop, more := fn(e.name)
+		if drop {
+			q.remove(e)
+		}
+		if !more {
+			return
+		}
+		le = prev
+	}
+}
+
+// Resize demotes the coldest hot files until the hot queue fits in limit,
+// as only the cold queue is evicted.
+func (q *twoQueue) Resize(limit int) {
+	q.limit = limit
+	hot := 0
+	for _, e := range q.mp {
+		if e.typ == H {
+			hot += e.size
+		}
+	}
+	for le := q.hq.Back(); le != nil && hot >= limit-limit/ColdMultiples; {
+		prev := le.Prev()
+		if e := le.Value.(*qEntry); e.typ == H {
+			hot -= e.size
+			q.hq.Remove(le)
+			e.h = nil
+			e.typ = C
+			e.c = q.cq.PushFront(e)
+		}
+		le = prev
+	}
+}
+
+func (q *twoQueue) Len() int {
+	return len(q.mp)
+}
+
+func (q *twoQueue) Stats() map[string]float64 {
+	hot := 0
+	for _, e := range q.mp {
+		if e.typ == H {
+			hot++
+		}
+	}
+	return map[string]float64{"hot_files": float64(hot), "cold_files": float64(len(q.mp) - hot)}
+}
+
+func (q *twoQueue) remove(e *qEntry) {
+	if e.h != nil {
+		q.hq.Remove(e.h)
+	}
+	if e.c != nil {
+		q.cq.Remove(e.c)
+	}
+	q.size -= e.size
+	delete(q.mp, e.name)
+}
+
+// reduce drops the cold files at the back of the hot queue
+func (q *twoQueue) reduce() {
+	for le := q.hq.Back(); le != nil; le = q.hq.Back() {
+		e := le.Value.(*qEntry)
+		if e.typ == H {
+			return
+		}
+		e.h = nil
+		q.hq.Remove(le)
+	}
+}
+
+// exchange demotes the coldest hot file
+func (q *twoQueue) exchange() {
+	if le := q.hq.Back(); le != nil {
+		e := le.Value.(*qEntry)
+		if e.typ != H {
+			return
+		}
+		q.hq.Remove(le)
+		e.h = nil
+		e.typ = C
+		e.c = q.cq.PushFront(e)
+	}
+}
+
+func (l *lru) Name() string {
+	return LRU
+}
+
+func (l *lru) Add(name string, _ int) {
+	l.mp[name] = l.l.PushFront(name)
+}
+
+func (l *lru) Access(name string, _ int) {
+	if e, ok := l.mp[name]; ok {
+		l.l.MoveToFront(e)
+	}
+}
+
+func (l *lru) Remove(name string) {
+	if e, ok := l.mp[name]; ok {
+		l.l.Remove(e)
+		delete(l.mp, name)
+	}
+}
+
+func (l *lru) Rename(oldname, newname string) {
+	if e, ok := l.mp[oldname]; ok {
+		delete(l.mp, oldname)
+		e.Value = newname
+		l.mp[newname] = e
+	}
+}
+
+func (l *lru) Evict(fn func(string) (bool, bool)) {
+	for e := l.l.Back(); e != nil; {
+		prev := e.Prev()
+		name := e.Value.(string)
+		drop, more := fn(name)
+		if drop {
+			l.l.Remove(e)
+			delete(l.mp, name)
+		}
+		if !more {
+			return
+		}
+		e = prev
+	}
+}
+
+func (l *lru) Resize(_ int) {}
+
+func (l *lru) Len() int {
+	return len(l.mp)
+}
+
+func (l *lru) Stats() map[string]float64 {
+	return map[string]float64{"files": float64(len(l.mp))}
+}
+
+// arc is the adaptive replacement cache with sizes in bytes: t1 holds the
+// files accessed once and t2 the files accessed more, b1 and b2 remember
+// the files evicted from them, and a hit in b1 or b2 moves the target size
+// p of t1 towards the list which would have kept the file.
+func newARCList() *arcList {
+	return &arcList{l: list.New()}
+}
+
+func (a *arc) Name() string {
+	return ARC
+}
+
+func (a *arc) Add(name string, size int) {
+	e, ok := a.mp[name]
+	switch {
+	case !ok:
+		e = &arcEntry{name: name, size: size}
+		a.mp[name] = e
+		a.t1.push(e)
+	case e.in == a.b1:
+		a.ghostHits++
+		a.p += size * max(a.b2.size/max(a.b1.size, 1), 1)
+		if a.p > a.c {
+			a.p = a.c
+		}
+		a.b1.remove(e)
+		e.size = size
+		a.t2.push(e)
+	case e.in == a.b2:
+		a.ghostHits++
+		a.p -= size * max(a.b1.size/max(a.b2.size, 1), 1)
+		if a.p < 0 {
+			a.p = 0
+		}
+		a.b2.remove(e)
+		e.size = size
+		a.t2.push(e)
+	default: // resident
+		a.Access(name, size-e.size)
+		return
+	}
+	a.trim()
+}
+
+func (a *arc) Access(name string, n int) {
+	e, ok := a.mp[name]
+	if !ok || e.in == a.b1 || e.in == a.b2 {
+		return
+	}
+	e.in.remove(e)
+	e.size += n
+	a.t2.push(e)
+}
+
+func (a *arc) Remove(name string) {
+	if e, ok := a.mp[name]; ok {
+		e.in.remove(e)
+		delete(a.mp, name)
+	}
+}
+
+func (a *arc) Rename(oldname, newname string) {
+	a.Remove(newname) // forgets a ghost of newname
+	if e, ok := a.mp[oldname]; ok {
+		delete(a.mp, oldname)
+		e.name = newname
+		a.mp[newname] = e
+	}
+}
+
+// Evict offers the back of t1 while t1 is larger than its target, and the
+// back of t2 otherwise.
+func (a *arc) Evict(fn func(string) (bool, bool)) {
+	c1, c2 := a.t1.l.Back(), a.t2.l.Back()
+	t1 := a.t1.size
+	for c1 != nil || c2 != nil {
+		var le *list.Element
+		if c1 != nil && (t1 > a.p || c2 == nil) {
+			le, c1 = c1, c1.Prev()
+		} else {
+			le, c2 = c2, c2.Prev()
+		}
+		e := le.Value.(*arcEntry)
+		drop, more := fn(e.name)
+		if drop {
+			ghost := a.b1
+			if e.in == a.t1 {
+				t1 -= e.size
+			} else {
+				ghost = a.b2
+			}
+			e.in.remove(e)
+			ghost.push(e)
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+func (a *arc) Resize(limit int) {
+	a.c = limit
+	if a.p > a.c {
+		a.p = a.c
+	}
+	a.trim()
+}
+
+func (a *arc) Len() int {
+	return a.t1.l.Len() + a.t2.l.Len()
+}
+
+func (a *arc) Stats() map[string]float64 {
+	return map[string]float64{
+		"p":          float64(a.p),
+		"t1_bytes":   float64(a.t1.size),
+		"t2_bytes":   float64(a.t2.size),
+		"b1_bytes":   float64(a.b1.size),
+		"b2_bytes":   float64(a.b2.size),
+		"ghost_hits": float64(a.ghostHits),
+	}
+}
+
+// trim bounds the ghost lists by the capacity
+func (a *arc) trim() {
+	for a.t1.size+a.b1.size > a.c && a.b1.l.Len() > 0 {
+		a.forget(a.b1)
+	}
+	for a.t1.size+a.t2.size+a.b1.size+a.b2.size > 2*a.c && a.b2.l.Len() > 0 {
+		a.forget(a.b2)
+	}
+}
+
+// forget drops the oldest file remembered by the ghost list l
+func (a *arc) forget(l *arcList) {
+	e := l.l.Back().Value.(*arcEntry)
+	l.remove(e)
+	delete(a.mp, e.name)
+}
+
+func (l *arcList) push(e *arcEntry) {
+	e.in, e.e = l, l.l.PushFront(e)
+	l.size += e.size
+}
+
+func (l *arcList) remove(e *arcEntry) {
+	l.l.Remove(e.e)
+	l.size -= e.size
+	e.in, e.e = nil, nil
+}
+
+// gdsf is greedy dual size frequency: a file has the priority
+// clock + frequency / size, the file of the lowest priority is evicted
+// first and the clock advances to its priority, so small files which are
+// accessed often are kept and files which are not accessed age out.
+func (g *gdsf) Name() string {
+	return GDSF
+}
+
+func (g *gdsf) Add(name string, size int) {
+	e := &gdsfEntry{name: name, size: size, freq: 1}
+	g.mp[name] = e
+	e.pri = g.priority(e)
+	heap.Push(&g.h, e)
+}
+
+// Access counts the reads toward the frequency of a file, writes only
+// grow it.
+func (g *gdsf) Access(name string, n int) {
+	if e, ok := g.mp[name]; ok {
+		if n > 0 {
+			e.size += n
+		} else {
+			e.freq++
+		}
+		e.pri = g.priority(e)
+		heap.Fix(&g.h, e.idx)
+	}
+}
+
+func (g *gdsf) Remove(name string) {
+	if e, ok := g.mp[name]; ok {
+		heap.Remove(&g.h, e.idx)
+		delete(g.mp, name)
+	}
+}
+
+func (g *gdsf) Rename(oldname, newname string) {
+	if e, ok := g.mp[oldname]; ok {
+		delete(g.mp, oldname)
+		e.name = newname
+		g.mp[newname] = e
+	}
+}
+
+func (g *gdsf) Evict(fn func(string) (bool, bool)) {
+	var kept []*gdsfEntry
+
+	for g.h.Len() > 0 {
+		e := heap.Pop(&g.h).(*gdsfEntry)
+		drop, more := fn(e.name)
+		if drop {
+			g.clock = e.pri
+			delete(g.mp, e.name)
+		} else {
+			kept = append(kept, e)
+		}
+		if !more {
+			break
+		}
+	}
+	for _, e := range kept {
+		heap.Push(&g.h, e)
+	}
+}
+
+func (g *gdsf) Resize(_ int) {}
+
+func (g *gdsf) Len() int {
+	return len(g.mp)
+}
+
+func (g *gdsf) Stats() map[string]float64 {
+	return map[string]float64{"clock": g.clock}
+}
+
+func (g *gdsf) priority(e *gdsfEntry) float64 {
+	return g.clock + float64(e.freq)/float64(max(e.size, 1))
+}
+
+func (h gdsfHeap) Len() int           { return len(h) }
+func (h gdsfHeap) Less(i, j int) bool { return h[i].pri < h[j].pri }
+
+func (h gdsfHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx, h[j].idx = i, j
+}
+
+func (h *gdsfHeap) Push(x interface{}) {
+	e := x.(*gdsfEntry)
+	e.idx = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *gdsfHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
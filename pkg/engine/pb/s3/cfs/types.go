@@ -15,50 +15,227 @@ const (
 	ColdMultiples = 1024
 )
 
+// eviction policies
+const (
+	TwoQueue = "2q"   // hot and cold queues, files are promoted on their second access
+	LRU      = "lru"  // least recently used
+	ARC      = "arc"  // adaptive replacement cache
+	GDSF     = "gdsf" // greedy dual size frequency, favours small files accessed often
+)
+
 const (
 	FlushSize = 1024 * 1024
 )
 
-type CallBack func(interface{}, string, string, int)
+// modes of files, combined by or
+const (
+	Pin          = 1 << iota // never evicted, dirty files are still written back
+	CacheOnRead              // read back into the cache from the store when read
+	WriteThrough             // written back on every sync
+	Bypass                   // dropped from the cache once written back
+)
+
+// DefaultRules evicts sst files and pins the other files, they follow
+// the rules given to New.
+var DefaultRules = []Rule{{"*.sst", 0}, {"*", Pin}}
+
+// Rule sets the mode of the files whose base name matches Pattern by
+// path.Match, the first matching rule applies.
+type Rule struct {
+	Pattern string
+	Mode    int
+}
+
+const (
+	// JournalName is the name of the write back journal in the cache
+	// directory, which records the files not written back yet.
+	JournalName        = ".journal"
+	JournalCompactSize = 64 * 1024
+)
+
+const (
+	JournalDirty = 'D'
+	JournalClean = 'C'
+)
+
+// CallBack is called with the path of the cache file, the path of the file,
+// and its size and generation to write it back, or a size of -1 if the
+// cache file can be dropped.
+type CallBack func(interface{}, string, string, int, uint64)
 
 type FS interface {
 	Close() error
 	Create(string) error
 	IsExist(string) (int64, bool)
+	// Version returns the size and the generation of a file.
+	Version(string) (int, uint64, bool)
 	Remove(string) (error, bool)
 	Link(string, string) (error, bool)
 	Rename(string, string) (error, bool)
+	// Clean marks a file as written back with the given size and
+	// generation, unless it has been modified or renamed over since.
+	Clean(string, int, uint64) error
+	// Sync flushes the buffer of a file and fsyncs it.
+	Sync(string) (error, bool)
 
 	RemoveAll(string) error
 	List(string) ([]string, error)
 
 	Write(string, []byte) (error, bool)
 	Read(string, int64, int) ([]byte, error, bool)
+	// Fill adds a clean file with the contents read from the store, unless
+	// it is in the cache or does not fit.
+	Fill(string, []byte) error
+
+	// Mode returns the mode of a file.
+	Mode(string) int
+	// Pin pins or unpins a file in the cache, overriding the rules.
+	Pin(string, bool) bool
+	// Replay calls back for the files which were dirty in the journal
+	// when the cache was opened, once the write back can consume them.
+	Replay()
+	// SetLimit sets the limit of the cache and evicts files until the
+	// cache is below it, pinned files are kept.
+	SetLimit(int)
+	Stats() Stats
+}
+
+// Policy orders the files of a cache for eviction. The methods are called
+// under the lock of the cache and sizes are in bytes.
+type Policy interface {
+	Name() string
+	// Add adds a file, which may have been evicted before.
+	Add(string, int)
+	// Access records an access of a file which grew by the given size,
+	// the accesses of writes grow files and those of reads don't.
+	Access(string, int)
+	Remove(string)
+	Rename(string, string)
+	// Evict offers the files in the order of eviction to a function which
+	// returns whether the file was dropped and whether to go on. Dropped
+	// files are removed from the policy.
+	Evict(func(string) (bool, bool))
+	// Resize sets the limit of the cache.
+	Resize(int)
+	// Len returns the number of files in the cache.
+	Len() int
+	// Stats returns the statistics specific to the policy.
+	Stats() map[string]float64
+}
+
+type Stats struct {
+	Policy    string
+	Files     int
+	Size      int
+	Limit     int
+	Hits      int64 // reads served by the cache
+	Misses    int64 // reads of files not in the cache
+	Evictions int64
+	Details   map[string]float64 // statistics of the policy
 }
 
+// The fields of a file are guarded by the lock of the cache, except that
+// size, buf, fi and removed are guarded by mu of the file, and path is
+// changed under both. mu is never taken while the lock of the cache is
+// held, a file found under the lock of the cache may be dropped before mu
+// is taken, which removed tells.
 type file struct {
-	typ     int
-	size    int
+	mu      sync.RWMutex
+	mode    int
+	size    int    // size of the cache file
+	used    int    // bytes accounted in the cache, including the writes in progress
+	gen     uint64 // given by touch when the file is modified or moved
 	dirty   bool
+	evicted bool // chosen by release, dropped once written back
+	removed bool
 	path    string
 	rowpath string
 	buf     []byte
 	fi      *os.File
-	h, c    *list.Element
 }
 
-type queue struct {
-	l *list.List
+// victim is a file chosen by release
+type victim struct {
+	f     *file
+	evict bool
 }
 
+type journal struct {
+	mu   sync.Mutex // guards fi and n
+	n    int        // number of records
+	path string
+	fi   *os.File
+	mp   map[string]struct{} // dirty files, guarded by the lock of the cache
+}
+
+type twoQueue struct {
+	size, limit int
+	hq, cq      *list.List
+	mp          map[string]*qEntry
+}
+
+type qEntry struct {
+	typ  int
+	size int
+	name string
+	h, c *list.Element
+}
+
+type lru struct {
+	l  *list.List
+	mp map[string]*list.Element
+}
+
+type arc struct {
+	c, p           int // capacity and target size of t1
+	t1, t2, b1, b2 *arcList
+	mp             map[string]*arcEntry
+	ghostHits      int64
+}
+
+type arcList struct {
+	size int
+	l    *list.List
+}
+
+type arcEntry struct {
+	size int
+	name string
+	in   *arcList
+	e    *list.Element
+}
+
+type gdsf struct {
+	clock float64
+	h     gdsfHeap
+	mp    map[string]*gdsfEntry
+}
+
+type gdsfEntry struct {
+	size int
+	freq int
+	idx  int // index in the heap
+	pri  float64
+	name string
+}
+
+type gdsfHeap []*gdsfEntry
+
 // cache filesystem
 type fs struct {
-	sync.RWMutex
-	size   int
-	limit  int
-	dir    string
-	hq, cq *queue
-	cbk    CallBack
-	usr    interface{}
-	mp     map[string]*file
+	sync.Mutex
+	size      int
+	limit     int
+	dir       string
+	pol       Policy
+	rules     []Rule
+	jnl       *journal
+	cbk       CallBack
+	usr       interface{}
+	mp        map[string]*file
+	gen       uint64   // last generation given to a file
+	replay    []string // dirty files of the journal at open
+	hits      int64
+	misses    int64
+	evictions int64
 }
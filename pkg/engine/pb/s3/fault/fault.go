@@ -0,0 +1,103 @@
+// Package fault injects errors, latency, truncated reads and dropped writes
+// into the s3 filesystem and its object store for resilience tests.
+package fault
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"time"
+)
+
+func New(seed int64) *Injector {
+	return &Injector{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Add adds the rule, the first rule which fires decides the faults of
+// an operation.
+func (inj *Injector) Add(r *Rule) *Rule {
+	inj.Lock()
+	defer inj.Unlock()
+	if r.Err == nil && r.Latency == 0 && r.Truncate == 0 && !r.Drop {
+		r.Err = ErrInjected
+	}
+	inj.rules = append(inj.rules, r)
+	return r
+}
+
+// Reset removes all rules
+func (inj *Injector) Reset() {
+	inj.Lock()
+	defer inj.Unlock()
+	inj.rules = nil
+}
+
+// Fired returns how many times the rule fired
+func (inj *Injector) Fired(r *Rule) int {
+	inj.Lock()
+	defer inj.Unlock()
+	return r.fired
+}
+
+// inject waits the latency of the rule fired by the operation, and
+// returns the rule, or nil if none fires.
+func (inj *Injector) inject(op Op, name string) *Rule {
+	var fired *Rule
+
+	inj.Lock()
+	for _, r := range inj.rules {
+		if r.Ops&op == 0 {
+			continue
+		}
+		if len(r.Pattern) > 0 {
+			if ok, _ := path.Match(r.Pattern, name); !ok {
+				continue
+			}
+		}
+		if r.n++; r.n <= r.After || (r.Times > 0 && r.fired >= r.Times) {
+			continue
+		}
+		if r.Probability > 0 && inj.rnd.Float64() >= r.Probability {
+			continue
+		}
+		r.fired++
+		fired = r
+		break
+	}
+	inj.Unlock()
+	if fired != nil && fired.Latency > 0 {
+		time.Sleep(fired.Latency)
+	}
+	return fired
+}
+
+// err returns the error injected into an operation which can't be truncated
+// or dropped.
+func (r *Rule) err() error {
+	if r == nil {
+		return nil
+	}
+	return r.Err
+}
+
+func (r *truncReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= n
+	return n, err
+}
+
+func (r *truncReader) Close() error {
+	return r.r.Close()
+}
+
+// drain consumes the data of a dropped upload
+func drain(r io.Reader) (int64, error) {
+	return io.Copy(ioutil.Discard, r)
+}
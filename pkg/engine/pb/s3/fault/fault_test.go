@@ -0,0 +1,119 @@
+package fault
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/deepfabric/thinkkv/pkg/engine"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
+)
+
+func TestRules(t *testing.T) {
+	inj := New(0)
+	st := inj.Store(store.NewMem())
+	st.CreateBucket("b")
+	after := inj.Add(&Rule{Ops: Put, Pattern: "b/*.sst", After: 2, Times: 1})
+	for i, name := range []string{"1.sst", "2.sst", "MANIFEST", "3.sst", "4.sst"} {
+		_, err := st.Put("b", name, strings.NewReader("data"), "")
+		if (err == ErrInjected) != (i == 3) {
+			t.Fatalf("put %v: %v", name, err)
+		}
+	}
+	if inj.Fired(after) != 1 {
+		t.Fatalf("fired %v", inj.Fired(after))
+	}
+	inj.Reset()
+	inj.Add(&Rule{Ops: Get, Truncate: 2})
+	r, err := st.Get("b", "1.sst", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(r); string(data) != "da" {
+		t.Fatalf("get: %q", data)
+	}
+	inj.Reset()
+	inj.Add(&Rule{Ops: Put, Drop: true})
+	if _, err := st.Put("b", "5.sst", strings.NewReader("data"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Head("b", "5.sst"); err == nil {
+		t.Fatal("upload not dropped")
+	}
+	inj.Reset()
+	half := inj.Add(&Rule{Ops: Head, Probability: 0.5})
+	for i := 0; i < 1000; i++ {
+		st.Head("b", "1.sst")
+	}
+	if n := inj.Fired(half); n < 400 || n > 600 {
+		t.Fatalf("fired %v", n)
+	}
+}
+
+func TestFS(t *testing.T) {
+	fs := New(0).FS(vfs.NewMem())
+	if _, ok := fs.(pb.CacheFS); ok {
+		t.Fatal("cache of a local filesystem")
+	}
+	if _, ok := fs.(pb.WarmFS); ok {
+		t.Fatal("warm up of a local filesystem")
+	}
+}
+
+func TestEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inj := New(0)
+	st := inj.Store(store.NewMem())
+	var puts *Rule
+	cfg := &s3.Config{CacheSize: 1 << 20, Retry: s3.RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+	for i := 0; i < 2; i++ {
+		cfg.CacheDir = fmt.Sprintf("%s/%v", dir, i)
+		a, fs, err := s3.Open(cfg, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go a.Run()
+		if _, ok := inj.FS(a).(pb.WarmFS); !ok {
+			t.Fatal("interfaces of the s3 filesystem not passed through")
+		}
+		db, err := pb.Open("test", inj.FS(a), &pb.Options{MemTableSize: 1 << 20, SyncWrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			puts = inj.Add(&Rule{Ops: Put, Pattern: "test/*.sst", Times: 3}) // retried by write back
+			for j := 0; j < 1000; j++ {
+				if err := db.Set([]byte(fmt.Sprintf("%04d", j)), make([]byte, 1024)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else {
+			if n := inj.Fired(puts); n != 3 {
+				t.Fatalf("%v uploads failed", n)
+			}
+			inj.Add(&Rule{Ops: Get, Pattern: "test/*.sst", Truncate: 1})
+			if _, err := db.Get([]byte("0500")); err != engine.Corruption {
+				t.Fatalf("get: %v", err)
+			}
+			inj.Reset()
+			for j := 0; j < 1000; j++ {
+				if _, err := db.Get([]byte(fmt.Sprintf("%04d", j))); err != nil {
+					t.Fatalf("get %v: %v", j, err)
+				}
+			}
+		}
+		db.Close()
+		fs.Close()
+		a.Stop()
+	}
+}
@@ -0,0 +1,213 @@
+package fault
+
+import (
+	"io"
+	"os"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb"
+)
+
+// FS wraps fs with the faults of the injector. The optional interfaces of
+// pb are passed through only if fs is the cache filesystem of s3.
+func (inj *Injector) FS(fs vfs.FS) vfs.FS {
+	f := &faultFS{inj, fs}
+	if _, ok := fs.(pb.CacheFS); ok {
+		return &cacheFS{f}
+	}
+	return f
+}
+
+func (fs *faultFS) Create(name string) (vfs.File, error) {
+	if err := fs.inj.inject(Create, name).err(); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{name, fs.inj, f}, nil
+}
+
+func (fs *faultFS) Link(oldname, newname string) error {
+	if err := fs.inj.inject(Link, newname).err(); err != nil {
+		return err
+	}
+	return fs.fs.Link(oldname, newname)
+}
+
+func (fs *faultFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	if err := fs.inj.inject(Open, name).err(); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.Open(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{name, fs.inj, f}, nil
+}
+
+func (fs *faultFS) OpenDir(name string) (vfs.File, error) {
+	if err := fs.inj.inject(Open, name).err(); err != nil {
+		return nil, err
+	}
+	return fs.fs.OpenDir(name)
+}
+
+func (fs *faultFS) Remove(name string) error {
+	if err := fs.inj.inject(Remove, name).err(); err != nil {
+		return err
+	}
+	return fs.fs.Remove(name)
+}
+
+func (fs *faultFS) RemoveAll(name string) error {
+	if err := fs.inj.inject(Remove, name).err(); err != nil {
+		return err
+	}
+	return fs.fs.RemoveAll(name)
+}
+
+func (fs *faultFS) Rename(oldname, newname string) error {
+	if err := fs.inj.inject(Rename, newname).err(); err != nil {
+		return err
+	}
+	return fs.fs.Rename(oldname, newname)
+}
+
+func (fs *faultFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	if err := fs.inj.inject(Rename, newname).err(); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{newname, fs.inj, f}, nil
+}
+
+func (fs *faultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if err := fs.inj.inject(Create, dir).err(); err != nil {
+		return err
+	}
+	return fs.fs.MkdirAll(dir, perm)
+}
+
+func (fs *faultFS) Lock(name string) (io.Closer, error) {
+	return fs.fs.Lock(name)
+}
+
+func (fs *faultFS) List(dir string) ([]string, error) {
+	if err := fs.inj.inject(List, dir).err(); err != nil {
+		return nil, err
+	}
+	return fs.fs.List(dir)
+}
+
+func (fs *faultFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.inj.inject(Stat, name).err(); err != nil {
+		return nil, err
+	}
+	return fs.fs.Stat(name)
+}
+
+func (fs *faultFS) PathBase(p string) string {
+	return fs.fs.PathBase(p)
+}
+
+func (fs *faultFS) PathJoin(elem ...string) string {
+	return fs.fs.PathJoin(elem...)
+}
+
+func (fs *faultFS) PathDir(p string) string {
+	return fs.fs.PathDir(p)
+}
+
+func (fs *cacheFS) Err() error {
+	if h, ok := fs.fs.(pb.HealthFS); ok {
+		return h.Err()
+	}
+	return nil
+}
+
+func (fs *cacheFS) IsCached(name string) bool {
+	return fs.fs.(pb.CacheFS).IsCached(name)
+}
+
+func (fs *cacheFS) TableDeleted(jobID int, name string, err error) {
+	if l, ok := fs.fs.(pb.TableListener); ok {
+		l.TableDeleted(jobID, name, err)
+	}
+}
+
+func (fs *cacheFS) TableLevel(name string, level int) {
+	if l, ok := fs.fs.(pb.LevelListener); ok {
+		l.TableLevel(name, level)
+	}
+}
+
+// Prefetch fails with the faults of Read.
+func (fs *cacheFS) Prefetch(name string, off, size int64) error {
+	if err := fs.inj.inject(Read, name).err(); err != nil {
+		return err
+	}
+	if w, ok := fs.fs.(pb.WarmFS); ok {
+		return w.Prefetch(name, off, size)
+	}
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	return f.f.Close()
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	rule := f.inj.inject(Read, f.name)
+	if err := rule.err(); err != nil {
+		return 0, err
+	}
+	if rule != nil && rule.Truncate > 0 && len(p) > rule.Truncate {
+		p = p[:rule.Truncate]
+	}
+	return f.f.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	rule := f.inj.inject(Read, f.name)
+	if err := rule.err(); err != nil {
+		return 0, err
+	}
+	if rule != nil && rule.Truncate > 0 && len(p) > rule.Truncate {
+		n, err := f.f.ReadAt(p[:rule.Truncate], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return f.f.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	rule := f.inj.inject(Write, f.name)
+	if err := rule.err(); err != nil {
+		return 0, err
+	}
+	if rule != nil && rule.Drop {
+		return len(p), nil
+	}
+	return f.f.Write(p)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.inj.inject(Stat, f.name).err(); err != nil {
+		return nil, err
+	}
+	return f.f.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.inj.inject(Sync, f.name).err(); err != nil {
+		return err
+	}
+	return f.f.Sync()
+}
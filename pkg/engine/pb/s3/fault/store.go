@@ -0,0 +1,80 @@
+package fault
+
+import (
+	"io"
+	"time"
+
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
+)
+
+// Store wraps st with the faults of the injector.
+func (inj *Injector) Store(st store.ObjectStore) store.ObjectStore {
+	return &faultStore{inj, st}
+}
+
+func (s *faultStore) CreateBucket(bucket string) error {
+	return s.st.CreateBucket(bucket)
+}
+
+func (s *faultStore) DeleteBucket(bucket string) error {
+	return s.st.DeleteBucket(bucket)
+}
+
+func (s *faultStore) Put(bucket, key string, r io.Reader, checksum string) (*store.Object, error) {
+	rule := s.inj.inject(Put, bucket+"/"+key)
+	switch {
+	case rule == nil:
+		return s.st.Put(bucket, key, r, checksum)
+	case rule.Err != nil:
+		return nil, rule.Err
+	case rule.Drop:
+		n, err := drain(r)
+		if err != nil {
+			return nil, err
+		}
+		return &store.Object{Key: key, Size: n, LastModified: time.Now(), Checksum: checksum}, nil
+	case rule.Truncate > 0: // partial upload
+		return s.st.Put(bucket, key, io.LimitReader(r, int64(rule.Truncate)), checksum)
+	}
+	return s.st.Put(bucket, key, r, checksum)
+}
+
+func (s *faultStore) Get(bucket, key string, off, n int64) (io.ReadCloser, error) {
+	rule := s.inj.inject(Get, bucket+"/"+key)
+	if err := rule.err(); err != nil {
+		return nil, err
+	}
+	r, err := s.st.Get(bucket, key, off, n)
+	if err != nil || rule == nil || rule.Truncate == 0 {
+		return r, err
+	}
+	return &truncReader{rule.Truncate, r}, nil
+}
+
+func (s *faultStore) Head(bucket, key string) (*store.Object, error) {
+	if err := s.inj.inject(Head, bucket+"/"+key).err(); err != nil {
+		return nil, err
+	}
+	return s.st.Head(bucket, key)
+}
+
+func (s *faultStore) Delete(bucket, key string) error {
+	if err := s.inj.inject(Delete, bucket+"/"+key).err(); err != nil {
+		return err
+	}
+	return s.st.Delete(bucket, key)
+}
+
+func (s *faultStore) List(bucket, prefix, delimiter, token string, max int) (*store.ListResult, error) {
+	if err := s.inj.inject(List, bucket+"/"+prefix).err(); err != nil {
+		return nil, err
+	}
+	return s.st.List(bucket, prefix, delimiter, token, max)
+}
+
+func (s *faultStore) Copy(srcBucket, srcKey, dstBucket, dstKey string) error {
+	if err := s.inj.inject(Copy, dstBucket+"/"+dstKey).err(); err != nil {
+		return err
+	}
+	return s.st.Copy(srcBucket, srcKey, dstBucket, dstKey)
+}
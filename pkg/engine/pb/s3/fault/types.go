@@ -0,0 +1,97 @@
+package fault
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
+)
+
+// operations of the filesystem and the object store selected by rules
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Open
+	Remove
+	Rename
+	Link
+	List
+	Stat
+	Read
+	Write
+	Sync
+
+	Put
+	Get
+	Head
+	Delete
+	Copy
+
+	FSOps    = Create | Open | Remove | Rename | Link | List | Stat | Read | Write | Sync
+	StoreOps = Put | Get | Head | Delete | List | Copy
+	AllOps   = FSOps | StoreOps
+)
+
+var (
+	// ErrInjected is the default error of rules.
+	ErrInjected = errors.New("injected fault")
+)
+
+// Rule selects the operations to inject faults into. A rule matches an
+// operation if the operation is in Ops and the path, or bucket/key of the
+// object, matches Pattern. It fires on the matching calls after the first
+// After ones with Probability, at most Times times.
+type Rule struct {
+	Ops         Op
+	Pattern     string  // path.Match pattern, empty matches all
+	After       int     // number of matching calls passed through first
+	Probability float64 // 0 means always
+	Times       int     // 0 means unlimited
+
+	Latency  time.Duration // delays the operation
+	Err      error         // fails the operation, ErrInjected if no other fault is set
+	Truncate int           // reads return and uploads store at most Truncate bytes
+	Drop     bool          // writes and uploads succeed without storing the data
+
+	n     int // matching calls
+	fired int
+}
+
+// Injector holds the rules shared by the wrapped filesystems and stores.
+type Injector struct {
+	sync.Mutex
+	rules []*Rule
+	rnd   *rand.Rand
+}
+
+type faultStore struct {
+	inj *Injector
+	st  store.ObjectStore
+}
+
+type faultFS struct {
+	inj *Injector
+	fs  vfs.FS
+}
+
+// cacheFS is the faultFS of the cache filesystem of s3, which also
+// passes through the optional interfaces of pb.
+type cacheFS struct {
+	*faultFS
+}
+
+type faultFile struct {
+	name string
+	inj  *Injector
+	f    vfs.File
+}
+
+type truncReader struct {
+	n int
+	r io.ReadCloser
+}
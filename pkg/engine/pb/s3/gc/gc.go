@@ -0,0 +1,161 @@
+// Package gc collects the objects of a database which are not referenced
+// by its current MANIFEST, such as the leftovers of crashed compactions
+// and failed renames.
+package gc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// Run opens the database dir read-only, and deletes or quarantines the
+// sst, MANIFEST, OPTIONS and temporary files which it doesn't reference
+// and which are older than the grace period. Logs are never collected.
+// It's safe to run against a database in use as long as the grace period
+// is longer than the run.
+func Run(fs vfs.FS, dir string, cfg Config) (*Report, error) {
+	if cfg.Grace <= 0 {
+		cfg.Grace = DefaultGrace
+	}
+	live, err := liveFiles(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{Live: len(live)}
+	now := time.Now()
+	for _, name := range names {
+		if _, ok := live[name]; ok || !collectable(name) {
+			continue
+		}
+		fi, err := fs.Stat(fs.PathJoin(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if now.Sub(fi.ModTime()) < cfg.Grace {
+			r.Kept++
+			continue
+		}
+		o := Orphan{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}
+		if !cfg.DryRun {
+			o.Err = collect(fs, dir, name, cfg.Quarantine)
+		}
+		r.Orphans = append(r.Orphans, o)
+	}
+	return r, nil
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+
+	var size int64
+	for _, o := range r.Orphans {
+		size += o.Size
+	}
+	fmt.Fprintf(&b, "%v live files, %v recent orphans kept, %v orphans of %v bytes\n", r.Live, r.Kept, len(r.Orphans), size)
+	for _, o := range r.Orphans {
+		fmt.Fprintf(&b, "%s\t%v\t%s", o.Name, o.Size, o.ModTime.Format(time.RFC3339))
+		if o.Err != nil {
+			fmt.Fprintf(&b, "\t%v", o.Err)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// liveFiles returns the tables referenced by the current MANIFEST of dir,
+// the MANIFEST itself and the latest OPTIONS file.
+func liveFiles(fs vfs.FS, dir string) (map[string]struct{}, error) {
+	db, err := pebble.Open(dir, &pebble.Options{FS: fs, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	live := make(map[string]struct{})
+	for _, level := range db.SSTables() {
+		for _, t := range level {
+			live[fmt.Sprintf("%06d.sst", t.FileNum)] = struct{}{}
+		}
+	}
+	manifest, err := current(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	live[manifest] = struct{}{}
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var options string
+	var max int64 = -1
+	for _, name := range names {
+		if n, ok := number(name, "OPTIONS-"); ok && n > max {
+			options, max = name, n
+		}
+	}
+	if max >= 0 {
+		live[options] = struct{}{}
+	}
+	return live, nil
+}
+
+// current returns the MANIFEST named by the CURRENT file
+func current(fs vfs.FS, dir string) (string, error) {
+	f, err := fs.Open(fs.PathJoin(dir, "CURRENT"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// collectable reports whether name is a file of pebble which may be
+// orphaned, logs are recycled by pebble and left alone.
+func collectable(name string) bool {
+	switch {
+	case strings.HasSuffix(name, ".sst"):
+		_, err := strconv.ParseUint(strings.TrimSuffix(name, ".sst"), 10, 64)
+		return err == nil
+	case strings.HasSuffix(name, ".dbtmp"):
+		return true
+	}
+	_, ok := number(name, "MANIFEST-")
+	if !ok {
+		_, ok = number(name, "OPTIONS-")
+	}
+	return ok
+}
+
+func number(name, prefix string) (int64, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return -1, false
+	}
+	n, err := strconv.ParseInt(name[len(prefix):], 10, 64)
+	return n, err == nil
+}
+
+func collect(fs vfs.FS, dir, name, quarantine string) error {
+	if len(quarantine) == 0 {
+		return fs.Remove(fs.PathJoin(dir, name))
+	}
+	if err := fs.MkdirAll(quarantine, 0755); err != nil {
+		return err
+	}
+	return fs.Rename(fs.PathJoin(dir, name), fs.PathJoin(quarantine, name))
+}
@@ -0,0 +1,75 @@
+package gc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepfabric/thinkkv/pkg/engine/pb"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
+)
+
+func TestGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	a, fs, err := s3.Open(&s3.Config{CacheSize: 1 << 20, CacheDir: dir}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	defer fs.Close()
+	db, err := pb.Open("test", a, &pb.Options{MemTableSize: 1 << 20, SyncWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"999999.sst", "MANIFEST-999998", "CURRENT.999997.dbtmp"} {
+		st.Put("test", name, strings.NewReader("orphan"), "")
+	}
+	r, err := Run(a, "test", Config{Grace: time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Live == 0 || r.Kept != 3 || len(r.Orphans) != 0 {
+		t.Fatalf("report: %v", r)
+	}
+	if r, err = Run(a, "test", Config{Grace: time.Nanosecond, Quarantine: "orphans"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Orphans) != 3 {
+		t.Fatalf("report: %v", r)
+	}
+	for _, o := range r.Orphans {
+		if o.Err != nil {
+			t.Fatal(o.Err)
+		}
+		if _, err := st.Head("orphans", o.Name); err != nil {
+			t.Fatalf("%v: %v", o.Name, err)
+		}
+	}
+	if db, err = pb.Open("test", a, &pb.Options{MemTableSize: 1 << 20, SyncWrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package gc
+
+import (
+	"time"
+)
+
+const (
+	DefaultGrace = 24 * time.Hour
+)
+
+type Config struct {
+	// Grace keeps the objects modified within it, which may belong to
+	// flushes, compactions and ingestions in progress. Defaults to
+	// DefaultGrace.
+	Grace time.Duration
+	// DryRun only reports the orphans.
+	DryRun bool
+	// Quarantine is the directory the orphans are moved to instead of
+	// being deleted, empty means delete.
+	Quarantine string
+}
+
+// Report is the result of a collection
+type Report struct {
+	Live    int // number of files referenced by the database
+	Kept    int // number of orphans within the grace period
+	Orphans []Orphan
+}
+
+type Orphan struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Err     error // error of deleting or quarantining, nil on dry runs
+}
@@ -2,39 +2,44 @@ package s3
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/cockroachdb/pebble/vfs"
+	"github.com/deepfabric/thinkkv/pkg/engine"
+	"github.com/deepfabric/thinkkv/pkg/engine/limiter"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/bcache"
 	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/cfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
 )
 
+// errGone reports a write back whose cache file was renamed or removed,
+// the file is written back under its new name if it is dirty.
+var errGone = errors.New("cache file is gone")
+
+// errShutdown fails the waiters of the write backs left pending by a
+// shutdown whose deadline expired.
+var errShutdown = errors.New("shut down before the write back completed")
+
 func New(cfg *Config, acl int) (*alis3, cfs.FS, error) {
-	a := new(alis3)
-	fs, err := cfs.New(cfg.CacheSize, cfg.CacheDir, a, writeback)
-	if err != nil {
-		return nil, nil, err
-	}
-	sess, err := session.NewSession(&aws.Config{
-		Endpoint:         &cfg.Endpoint,
-		Region:           aws.String(cfg.Region),
-		S3ForcePathStyle: aws.Bool(true),
-		Credentials:      credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.AccessKeySecret, ""),
-	})
+	sess, err := newSession(cfg)
 	if err != nil {
-		fs.Close()
 		return nil, nil, err
 	}
 	var opt string
@@ -48,13 +53,96 @@ func New(cfg *Config, acl int) (*alis3, cfs.FS, error) {
 	default:
 		opt = "private"
 	}
-	a.ch = make(chan struct{})
+	return Open(cfg, store.NewAWS(sess, opt))
+}
+
+// newSession creates the session with the static keys of cfg, or with the
+// credentials found by the provider chain if there are none.
+func newSession(cfg *Config) (*session.Session, error) {
+	acfg := aws.Config{
+		Endpoint:         &cfg.Endpoint,
+		Region:           aws.String(cfg.Region),
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	if len(cfg.AccessKeyID) > 0 {
+		acfg.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.AccessKeySecret, cfg.SessionToken)
+		return session.NewSession(&acfg)
+	}
+	c := cfg.Credentials
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            acfg,
+		Profile:           c.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+		SharedConfigFiles: c.Files,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(c.WebIdentityTokenFile) > 0 {
+		role, name := c.RoleARN, c.RoleSessionName
+		if len(role) == 0 {
+			role = os.Getenv("AWS_ROLE_ARN")
+		}
+		if len(name) == 0 {
+			name = os.Getenv("AWS_ROLE_SESSION_NAME")
+		}
+		// sts is not served by the endpoint of s3
+		p := stscreds.NewWebIdentityRoleProvider(sts.New(sess, &aws.Config{Endpoint: aws.String("")}),
+			role, name, c.WebIdentityTokenFile)
+		p.ExpiryWindow = c.ExpiryWindow
+		sess.Config.Credentials = credentials.NewCredentials(p)
+	}
+	return sess, nil
+}
+
+// Open returns a filesystem on top of the object store st, the
+// credential settings of cfg are not used.
+func Open(cfg *Config, st store.ObjectStore) (*alis3, cfs.FS, error) {
+	a := new(alis3)
+	a.ch, a.quit = make(chan struct{}), make(chan struct{})
+	a.pend = make(map[string]*message)
 	a.mch = make(chan *message, 1024)
-	a.fs, a.opt, a.cli, a.mp, a.sess = fs, opt, s3.New(sess), new(sync.Map), sess
+	a.dels, a.el = new(sync.Map), cfg.EventListener
+	a.fails, a.retry = new(sync.Map), cfg.Retry
+	if a.retry.MaxAttempts <= 0 {
+		a.retry.MaxAttempts = DefaultMaxAttempts
+	}
+	if a.retry.MinBackoff <= 0 {
+		a.retry.MinBackoff = DefaultMinBackoff
+	}
+	if a.retry.MaxBackoff <= 0 {
+		a.retry.MaxBackoff = DefaultMaxBackoff
+	}
+	a.lim = limiter.New(cfg.UploadBytesPerSec, 0)
+	a.bc = bcache.New(int64(cfg.BlockSize), int64(cfg.BlockCacheSize), cfg.Readahead)
+	a.layout, a.bucket, a.prefix = cfg.Layout, cfg.Bucket, cfg.Prefix
+	a.ups, a.dir, a.dura = new(sync.Map), cfg.CacheDir, cfg.Durability
+	a.pins = cfg.PinLevels
+	a.mds = new(sync.Map)
+	a.st, a.mp = st, new(sync.Map)
+	pol, err := cfs.NewPolicy(cfg.CachePolicy, cfg.CacheSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the dirty files of the journal are written back once Run starts
+	fs, err := cfs.New(cfg.CacheSize, cfg.CacheDir, pol, cfg.CacheRules, a, writeback)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.fs = fs
+	a.limit, a.watch, a.wstop, a.free = cfg.CacheSize, cfg.DiskWatch, make(chan struct{}), freeSpace
+	if a.watch.MinFree > 0 {
+		if a.watch.Interval <= 0 {
+			a.watch.Interval = DefaultDiskWatchInterval
+		}
+		a.resize()
+		go a.watchDisk()
+	}
 	return a, fs, nil
 }
 
 func (a *alis3) Run() {
+	go a.fs.Replay()
 	for {
 		select {
 		case <-a.ch:
@@ -63,62 +151,274 @@ func (a *alis3) Run() {
 				a.wg.Add(1)
 				go a.dealMessage(msg)
 			}
-			a.ch <- struct{}{}
+			select {
+			case a.ch <- struct{}{}:
+			case <-a.quit:
+			}
 			return
 		case msg := <-a.mch:
 			a.wg.Add(1)
 			go a.dealMessage(msg)
+		case <-a.quit:
+			return
 		}
 	}
 }
 
 func (a *alis3) Stop() {
-	a.ch <- struct{}{}
-	<-a.ch
-	close(a.ch)
-	a.wg.Wait()
-	close(a.mch)
+	a.Shutdown(context.Background())
+}
+
+func (a *alis3) Shutdown(ctx context.Context) ([]string, error) {
+	err := a.fs.Close() // queues the dirty files
+	a.qmu.Lock()
+	if a.closed {
+		a.qmu.Unlock()
+		return a.pending(), err
+	}
+	a.closed = true
+	a.qmu.Unlock()
+	close(a.wstop)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case a.ch <- struct{}{}: // Run drains the queue
+		case <-a.quit:
+			return
+		}
+		select {
+		case <-a.ch:
+		case <-a.quit:
+			return
+		}
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(a.quit)
+		for drained := false; !drained; {
+			select {
+			case msg := <-a.mch:
+				a.abort(msg)
+			default:
+				drained = true
+			}
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return a.pending(), err
+}
+
+// queue queues the write back of msg, or keeps it pending after shutdown
+func (a *alis3) queue(msg *message) {
+	a.qmu.RLock()
+	defer a.qmu.RUnlock()
+	a.pmu.Lock()
+	a.pend[msg.rowpath] = msg
+	a.pmu.Unlock()
+	if !a.closed {
+		a.mch <- msg
+	} else {
+		a.abort(msg)
+	}
+}
+
+// done removes msg from the pending write backs and wakes up its waiters,
+// unless the path is queued again
+func (a *alis3) done(msg *message) {
+	a.pmu.Lock()
+	if a.pend[msg.rowpath] == msg {
+		delete(a.pend, msg.rowpath)
+	}
+	if v, ok := a.mp.Load(msg.rowpath); ok && v.(*message) == msg {
+		a.mp.Delete(msg.rowpath)
+	}
+	a.pmu.Unlock()
+	close(msg.done)
+}
+
+func (a *alis3) pending() []string {
+	a.pmu.Lock()
+	defer a.pmu.Unlock()
+	rs := make([]string, 0, len(a.pend))
+	for name := range a.pend {
+		rs = append(rs, name)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+func (a *alis3) IsCached(name string) bool {
+	_, ok := a.fs.IsExist(name)
+	return ok
+}
+
+func (a *alis3) CacheStats() cfs.Stats {
+	return a.fs.Stats()
+}
+
+func (a *alis3) SetLimit(limit int) {
+	a.wmu.Lock()
+	a.limit = limit
+	a.wmu.Unlock()
+	a.resize()
+}
+
+// watchDisk resizes the cache by the free space of its disk until shutdown
+func (a *alis3) watchDisk() {
+	t := time.NewTicker(a.watch.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			a.resize()
+		case <-a.wstop:
+			return
+		}
+	}
+}
+
+// resize sets the limit of the cache to the limit set by SetLimit, less
+// the space missing on the disk below DiskWatch.MinFree.
+func (a *alis3) resize() {
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	limit := a.limit
+	if a.watch.MinFree > 0 {
+		free, err := a.free(a.dir)
+		if err != nil { // keeps the limit until the disk can be checked again
+			return
+		}
+		if n := int64(a.fs.Stats().Size) + free - a.watch.MinFree; n < int64(limit) {
+			limit = int(n)
+			if limit < 0 {
+				limit = 0
+			}
+		}
+	}
+	a.fs.SetLimit(limit)
 }
 
 func (a *alis3) Create(name string) (vfs.File, error) {
 	if err := a.fs.Create(name); err != nil {
 		return nil, err
 	}
-	s := strings.Split(name, "/")
-	return &file{s[0], s[1], a, a.fs}, nil
+	a.mds.Delete(name)
+	a.bc.Invalidate(name)
+	return a.newFile(name, false), nil
 }
 
 func (a *alis3) Remove(name string) error {
 	if err, ok := a.fs.Remove(name); ok && err != nil {
 		return err
 	}
-	s := strings.Split(name, "/")
-	if _, err := a.cli.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(s[0]),
-		Key:    aws.String(s[1]),
-	}); err != nil {
+	a.forget(name)
+	bucket, key := a.locate(name)
+	err := a.st.Delete(bucket, key)
+	a.mds.Delete(name)
+	a.bc.Invalidate(name)
+	if isSST(name) {
+		a.dels.Store(name, err)
+	}
+	return err
+}
+
+// forget drops the write back of a removed path, and the cache file which
+// the cache keeps for it.
+func (a *alis3) forget(name string) {
+	a.pmu.Lock()
+	a.mp.Delete(name)
+	a.pmu.Unlock()
+	os.Remove(filepath.Join(a.dir, name))
+}
+
+// Prefetch reads a file into the cache as a whole if size is negative,
+// or size bytes at off into the block cache if it is an sst file.
+func (a *alis3) Prefetch(name string, off, size int64) error {
+	if _, ok := a.fs.IsExist(name); ok {
+		return nil
+	}
+	f := a.newFile(name, false)
+	if err := f.wait(name); err != nil {
 		return err
 	}
-	return nil
+	if size < 0 {
+		return f.fill()
+	}
+	if a.bc == nil || !isSST(name) {
+		return nil
+	}
+	o, err := f.head()
+	if err != nil {
+		return err
+	}
+	_, err = a.bc.ReadAt(name, o.Size, make([]byte, size), off, f.fetch)
+	return err
+}
+
+// TableLevel pins the sst files of the levels below PinLevels.
+func (a *alis3) TableLevel(name string, level int) {
+	if a.pins > 0 {
+		a.fs.Pin(name, level < a.pins)
+	}
+}
+
+func (a *alis3) TableDeleted(jobID int, name string, err error) {
+	v, ok := a.dels.Load(name)
+	if !ok {
+		return
+	}
+	a.dels.Delete(name)
+	if a.el.ObjectDeleted == nil {
+		return
+	}
+	if err == nil && v != nil {
+		err = v.(error)
+	}
+	a.el.ObjectDeleted(ObjectDeleteInfo{jobID, name, err})
 }
 
 func (a *alis3) RemoveAll(name string) error {
 	if err := a.fs.RemoveAll(name); err != nil {
 		return err
 	}
-	if s := strings.Split(name, "/"); len(s) > 2 {
-		return a.Remove(name)
-	}
-	iter := s3manager.NewDeleteListIterator(a.cli, &s3.ListObjectsInput{
-		Bucket: aws.String(name),
+	a.mp.Range(func(k, _ interface{}) bool {
+		if s := k.(string); s == name || strings.HasPrefix(s, name+"/") {
+			a.forget(s)
+		}
+		return true
 	})
-	if err := s3manager.NewBatchDeleteWithClient(a.cli).Delete(aws.BackgroundContext(), iter); err != nil {
-		return err
+	a.mds.Range(func(k, _ interface{}) bool {
+		if s := k.(string); s == name || strings.HasPrefix(s, name+"/") {
+			a.mds.Delete(k)
+		}
+		return true
+	})
+	a.bc.Invalidate(name)
+	a.bc.InvalidatePrefix(name + "/")
+	bucket, key := a.locate(name)
+	if a.layout == BucketPerDir && len(key) == 0 {
+		if err := a.st.DeleteBucket(bucket); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
 	}
-	if _, err := a.cli.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(name)}); err != nil {
+	if err := a.st.Delete(bucket, key); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	if err := a.cli.WaitUntilBucketNotExists(&s3.HeadBucketInput{Bucket: aws.String(name)}); err != nil {
+	err := a.list(bucket, key+"/", "", func(resp *store.ListResult) error {
+		for _, o := range resp.Objects {
+			if err := a.st.Delete(bucket, o.Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
@@ -132,81 +432,41 @@ func (a *alis3) ReuseForWrite(oldname, newname string) (vfs.File, error) {
 }
 
 func (a *alis3) Link(oldname, newname string) error {
-	var r io.Reader
-
-	if err, ok := a.fs.Rename(oldname, newname); ok && err != nil {
-		return err
-	}
-	{
-		s := strings.Split(oldname, "/")
-		buf := aws.NewWriteAtBuffer([]byte{})
-		if _, err := s3manager.NewDownloader(a.sess).Download(buf, &s3.GetObjectInput{
-			Bucket: aws.String(s[0]),
-			Key:    aws.String(s[1]),
-		}); err != nil {
-			switch code := err.(awserr.RequestFailure).StatusCode(); code {
-			case 403, 404:
-				return nil
-			}
-			return err
-		}
-		r = bytes.NewReader(buf.Bytes())
-	}
-	{
-		s := strings.Split(newname, "/")
-		if _, err := s3manager.NewUploader(a.sess).Upload(&s3manager.UploadInput{
-			Body:   r,
-			Bucket: aws.String(s[0]),
-			Key:    aws.String(s[1]),
-		}); err != nil {
-			return err
-		}
+	if err, ok := a.fs.Link(oldname, newname); ok {
+		return err // the new file is dirty in cache and will be written back
 	}
-	return nil
+	return a.copy(oldname, newname)
 }
 
 func (a *alis3) Rename(oldname, newname string) error {
-	var r io.Reader
-
-	if err, ok := a.fs.Rename(oldname, newname); ok && err != nil {
+	err, ok := a.fs.Rename(oldname, newname)
+	switch {
+	case ok && err != nil:
 		return err
-	}
-	{
-		s := strings.Split(oldname, "/")
-		buf := aws.NewWriteAtBuffer([]byte{})
-		if _, err := s3manager.NewDownloader(a.sess).Download(buf, &s3.GetObjectInput{
-			Bucket: aws.String(s[0]),
-			Key:    aws.String(s[1]),
-		}); err != nil {
-			switch code := err.(awserr.RequestFailure).StatusCode(); code {
-			case 403, 404:
-				return nil
-			}
+	case !ok: // the write back of oldname is copied once it completes
+		if err := a.newFile(oldname, false).wait(oldname); err != nil {
 			return err
 		}
-		r = bytes.NewReader(buf.Bytes())
 	}
-	{
-		s := strings.Split(newname, "/")
-		if _, err := s3manager.NewUploader(a.sess).Upload(&s3manager.UploadInput{
-			Body:   r,
-			Bucket: aws.String(s[0]),
-			Key:    aws.String(s[1]),
-		}); err != nil {
-			return err
-		}
+	if err := a.copy(oldname, newname); err != nil {
+		return err
 	}
 	return a.Remove(oldname)
 }
 
+// MkdirAll creates the bucket if needed and a zero-sized marker object
+// whose key ends with a slash for the directory.
 func (a *alis3) MkdirAll(dir string, _ os.FileMode) error {
-	if _, err := a.cli.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(dir)}); err != nil {
-		if err.(awserr.RequestFailure).StatusCode() == 409 {
-			return nil
+	bucket, key := a.locate(dir)
+	if a.layout == BucketPerDir {
+		if err := a.st.CreateBucket(bucket); err != nil {
+			return err
 		}
-		return err
 	}
-	if err := a.cli.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(dir)}); err != nil {
+	if len(key) == 0 {
+		return nil
+	}
+	if _, err := a.st.Put(bucket, key+"/", bytes.NewReader(nil), ""); err != nil {
 		return err
 	}
 	return nil
@@ -217,26 +477,23 @@ func (a *alis3) Lock(name string) (io.Closer, error) {
 }
 
 func (a *alis3) OpenDir(name string) (vfs.File, error) {
-	return &file{name, "", a, a.fs}, nil
+	if ok, err := a.isDir(name); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, os.ErrNotExist
+	}
+	return a.newFile(name, true), nil
 }
 
 func (a *alis3) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
-	s := strings.Split(name, "/")
+	f := a.newFile(name, false)
 	if _, ok := a.fs.IsExist(name); !ok { // file not exist in cache
 		if _, ok := a.mp.Load(name); !ok {
-			if _, err := a.cli.HeadObject(&s3.HeadObjectInput{
-				Bucket: aws.String(s[0]),
-				Key:    aws.String(s[1]),
-			}); err != nil {
-				switch code := err.(awserr.RequestFailure).StatusCode(); code {
-				case 403, 404:
-					return nil, os.ErrNotExist
-				}
+			if _, err := f.head(); err != nil {
 				return nil, err
 			}
 		}
 	}
-	f := &file{s[0], s[1], a, a.fs}
 	for _, opt := range opts {
 		opt.Apply(f)
 	}
@@ -245,37 +502,72 @@ func (a *alis3) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
 
 func (a *alis3) Stat(name string) (os.FileInfo, error) {
 	f, err := a.Open(name)
-	if err != nil {
+	if err == nil {
+		return f.(*file), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f, err = a.OpenDir(name); err != nil {
 		return nil, err
 	}
 	return f.(*file), nil
 }
 
+// List returns the names of the files and the sub directories in dir.
 func (a *alis3) List(dir string) ([]string, error) {
-	resp, err := a.cli.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(dir)})
-	if err != nil {
+	fs, err := a.fs.List(dir)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
+	locals := make(map[string]struct{}, len(fs))
+	for _, name := range fs {
+		locals[name] = struct{}{}
+	}
+	bucket, prefix := a.locate(dir)
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
 	rs := []string{}
-	for _, item := range resp.Contents {
-		rs = append(rs, *item.Key)
+	if err := a.list(bucket, prefix, "/", func(resp *store.ListResult) error {
+		for i, item := range resp.Objects {
+			if name := item.Key[len(prefix):]; len(name) > 0 { // skip the marker of dir
+				rs = append(rs, name)
+				delete(locals, name)
+				a.mds.Store(path.Join(dir, name), &resp.Objects[i])
+			}
+		}
+		for _, p := range resp.Prefixes {
+			name := strings.TrimSuffix(p[len(prefix):], "/")
+			rs = append(rs, name)
+			delete(locals, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	{
-		fs, err := a.fs.List(dir)
+	for _, name := range fs {
+		if _, ok := locals[name]; ok {
+			rs = append(rs, name)
+		}
+	}
+	return rs, nil
+}
+
+// list calls fn with every page of the objects under prefix
+func (a *alis3) list(bucket, prefix, delimiter string, fn func(*store.ListResult) error) error {
+	for token := ""; ; {
+		resp, err := a.st.List(bucket, prefix, delimiter, token, 0)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		mp := make(map[string]struct{})
-		for _, s := range rs {
-			mp[s] = struct{}{}
+		if err := fn(resp); err != nil {
+			return err
 		}
-		for i, j := 0, len(fs); i < j; i++ {
-			if _, ok := mp[fs[i]]; !ok {
-				rs = append(rs, fs[i])
-			}
+		if token = resp.Token; len(token) == 0 {
+			return nil
 		}
 	}
-	return rs, nil
 }
 
 func (a *alis3) PathBase(p string) string {
@@ -290,97 +582,392 @@ func (a *alis3) PathDir(p string) string {
 	return path.Dir(p)
 }
 
+func (a *alis3) Err() error {
+	a.errMu.Lock()
+	defer a.errMu.Unlock()
+	return a.err
+}
+
+func (a *alis3) Retry() {
+	a.errMu.Lock()
+	a.err = nil
+	a.errMu.Unlock()
+	a.fails.Range(func(k, v interface{}) bool {
+		msg := v.(*failure).msg
+		retry := newMessage(msg.size, msg.gen, msg.path, msg.rowpath)
+		a.pmu.Lock()
+		if v, ok := a.mp.Load(msg.rowpath); ok && v.(*message) == msg {
+			a.mp.Store(msg.rowpath, retry)
+		}
+		a.pmu.Unlock()
+		a.fails.Delete(k)
+		a.queue(retry)
+		return true
+	})
+}
+
 func (a *alis3) dealMessage(msg *message) {
 	defer a.wg.Done()
-	s := strings.Split(msg.rowpath, "/")
-	for {
-		f, err := os.Open(msg.path)
-		if err != nil {
-			continue
+	start := time.Now()
+	for i := 1; ; i++ {
+		err := a.upload(msg)
+		if err == nil || err == errGone {
+			a.done(msg)
+			return
 		}
-		if _, err := s3manager.NewUploader(a.sess).Upload(&s3manager.UploadInput{
-			Body:   f,
-			Bucket: aws.String(s[0]),
-			Key:    aws.String(s[1]),
-		}); err != nil {
-			continue
+		if !store.IsRetryable(err) || i >= a.retry.MaxAttempts ||
+			(a.retry.Deadline > 0 && time.Since(start) >= a.retry.Deadline) {
+			a.fail(msg, i, err)
+			return
 		}
-		if isSST(s[1]) {
-			os.Remove(msg.path)
+		select {
+		case <-time.After(a.backoff(i - 1)):
+		case <-a.quit: // shut down, left to the next open
+			a.abort(msg)
+			return
 		}
-		return
 	}
 }
 
-func (f *file) Sync() error {
+func (a *alis3) upload(msg *message) error {
+	if err := a.put(msg); err != nil {
+		return err
+	}
+	if err := a.fs.Clean(msg.rowpath, msg.size, msg.gen); err != nil {
+		return err
+	}
+	if _, ok := a.fs.IsExist(msg.rowpath); !ok { // dropped by the cache
+		os.Remove(msg.path)
+	}
 	return nil
 }
 
-func (f *file) Close() error {
+// put uploads the cache file of msg
+func (a *alis3) put(msg *message) error {
+	v, _ := a.ups.LoadOrStore(msg.rowpath, new(sync.Mutex))
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+	bucket, key := a.locate(msg.rowpath)
+	pri := limiter.High
+	if isSST(key) {
+		pri = limiter.Low
+	}
+	f, err := os.Open(msg.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errGone
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size, h := fi.Size(), store.NewHash()
+	if _, err := io.Copy(h, io.LimitReader(f, size)); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// the file is append only, the checksum covers the first size bytes
+	// and the verifier fails the upload if they are changed meanwhile
+	sum := store.Checksum(h)
+	r := newVerifier(msg.rowpath, sum, size, io.LimitReader(f, size))
+	o, err := a.st.Put(bucket, key, limiter.NewReader(r, a.lim, pri), sum)
+	if err != nil {
+		return err
+	}
+	if o.Size != size {
+		return &CorruptionError{msg.rowpath, fmt.Sprintf("uploaded %v bytes, expected %v", o.Size, size)}
+	}
+	if o.LastModified.IsZero() { // incomplete metadata, looked up on demand
+		a.mds.Delete(msg.rowpath)
+	} else {
+		a.mds.Store(msg.rowpath, o)
+	}
+	a.bc.Invalidate(msg.rowpath)
 	return nil
 }
 
-func (f *file) Read(p []byte) (int, error) {
-	isEof := false
-	if size := int(f.Size()); len(p) > size {
-		p = p[:size]
-		isEof = true
+// head returns the metadata of the remote object of name. The metadata
+// of listed and uploaded objects is used once, it is kept by the file
+// which looked it up, so mds only keeps the objects not opened since.
+func (a *alis3) head(name string) (*store.Object, error) {
+	if v, ok := a.mds.Load(name); ok {
+		a.mds.Delete(name)
+		return v.(*store.Object), nil
 	}
-	if len(p) == 0 {
-		if isEof {
-			return 0, io.EOF
+	bucket, key := a.locate(name)
+	return a.st.Head(bucket, key)
+}
+
+// fail keeps the failed write back for Retry and reports it
+func (a *alis3) fail(msg *message, attempts int, err error) {
+	err = &UploadError{msg.rowpath, err}
+	a.fails.Store(msg.rowpath, &failure{msg, err})
+	defer close(msg.done)
+	a.errMu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.errMu.Unlock()
+	if a.el.UploadFailed != nil {
+		a.el.UploadFailed(UploadFailInfo{msg.rowpath, attempts, err})
+	}
+}
+
+// abort leaves msg pending on shutdown, its waiters fail with errShutdown
+func (a *alis3) abort(msg *message) {
+	a.fails.Store(msg.rowpath, &failure{msg, &UploadError{msg.rowpath, errShutdown}})
+	close(msg.done)
+}
+
+func (a *alis3) backoff(n int) time.Duration {
+	d := a.retry.MaxBackoff
+	if n < 32 && a.retry.MinBackoff<<uint(n) < d {
+		d = a.retry.MinBackoff << uint(n)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// copy copies the remote object of oldname to newname, it's not an error
+// if the object of oldname has not been written back.
+func (a *alis3) copy(oldname, newname string) error {
+	srcBucket, srcKey := a.locate(oldname)
+	dstBucket, dstKey := a.locate(newname)
+	a.mds.Delete(newname)
+	a.bc.Invalidate(newname)
+	err := a.st.Copy(srcBucket, srcKey, dstBucket, dstKey)
+	if err == engine.NotSupport { // stream the object through
+		var o *store.Object
+		var r io.ReadCloser
+
+		if o, err = a.st.Head(srcBucket, srcKey); err == nil {
+			if r, err = a.st.Get(srcBucket, srcKey, 0, -1); err == nil {
+				_, err = a.st.Put(dstBucket, dstKey, newVerifier(oldname, o.Checksum, o.Size, r), o.Checksum)
+				r.Close()
+			}
 		}
-		return 0, nil
 	}
-	name := f.dir + "/" + f.name
-	if data, err, ok := f.fs.Read(name, 0, len(p)); ok {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (a *alis3) newFile(name string, dir bool) *file {
+	bucket, key := a.locate(name)
+	return &file{dir: dir, path: name, bucket: bucket, key: key, a: a, fs: a.fs}
+}
+
+// locate returns the bucket and the key of name
+func (a *alis3) locate(name string) (string, string) {
+	if a.layout == SingleBucket {
+		return a.bucket, strings.TrimPrefix(path.Join(a.prefix, name), "/")
+	}
+	return split(strings.TrimPrefix(path.Clean(name), "/"))
+}
+
+// isDir reports whether name is a directory, which is the case if it is
+// a bucket, if there are objects under it or if it exists in the cache.
+func (a *alis3) isDir(name string) (bool, error) {
+	if _, err := a.fs.List(name); err == nil {
+		return true, nil
+	}
+	bucket, key := a.locate(name)
+	if len(key) > 0 {
+		key += "/"
+	}
+	resp, err := a.st.List(bucket, key, "/", "", 1)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return len(key) == 0 || len(resp.Objects) > 0 || len(resp.Prefixes) > 0, nil
+}
+
+// wait waits for the write back of name to complete
+func (f *file) wait(name string) error {
+	for {
+		v, ok := f.a.mp.Load(name)
+		if !ok {
+			return nil
+		}
+		msg := v.(*message)
+		<-msg.done
+		if v, ok := f.a.fails.Load(name); ok && v.(*failure).msg == msg {
+			return v.(*failure).err
+		}
+		if v, ok := f.a.mp.Load(name); ok && v.(*message) == msg {
+			return nil // the failure was cleared
+		}
+	}
+}
+
+// fill reads the remote object into the cache, the reads of a path
+// are serialized with its uploads.
+func (f *file) fill() error {
+	v, _ := f.a.ups.LoadOrStore(f.path, new(sync.Mutex))
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := f.fs.IsExist(f.path); ok {
+		return nil
+	}
+	data, err := f.fetchAll()
+	if err != nil {
+		return err
+	}
+	return f.fs.Fill(f.path, data)
+}
+
+// read reads len(p) bytes at off from the remote object of size
+func (f *file) read(p []byte, off, size int64) (int, error) {
+	if isSST(f.path) { // sst files are immutable, their blocks can be cached
+		n, err := f.a.bc.ReadAt(f.path, size, p, off, f.fetch)
 		if err != nil {
-			return -1, nil
+			return 0, err
 		}
-		copy(p, data)
-		if isEof {
-			return len(p), io.EOF
+		return n, nil
+	}
+	data, err := f.fetch(off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, data), nil
+}
+
+// head returns the metadata of the remote object, it is looked up once
+// by the file.
+func (f *file) head() (*store.Object, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.o == nil {
+		o, err := f.a.head(f.path)
+		if err != nil {
+			return nil, err
 		}
-		return len(p), nil
+		f.o = o
 	}
-	if size, ok := f.a.mp.Load(name); ok {
-		for { // waiting for synchronization to complete
-			if md, err := f.a.cli.HeadObject(&s3.HeadObjectInput{
-				Bucket: aws.String(f.dir),
-				Key:    aws.String(f.name),
-			}); err != nil {
-				if code := err.(awserr.RequestFailure).StatusCode(); code != 403 && code != 404 {
-					return -1, err
-				}
-			} else {
-				if int(*md.ContentLength) == size.(int) {
-					break
-				}
-			}
+	return f.o, nil
+}
+
+// fetch reads n bytes of the remote object at off, ranged reads are not
+// verified as the checksum covers the object as a whole.
+func (f *file) fetch(off, n int64) ([]byte, error) {
+	o, err := f.head()
+	if err != nil {
+		return nil, err
+	}
+	if off == 0 && n >= o.Size {
+		return f.fetchAll()
+	}
+	if off+n > o.Size {
+		n = o.Size - off
+	}
+	r, err := f.a.st.Get(f.bucket, f.key, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return f.readFull(r, off, n)
+}
+
+// fetchAll reads the remote object as a whole and verifies it against
+// its checksum.
+func (f *file) fetchAll() ([]byte, error) {
+	o, err := f.head()
+	if err != nil {
+		return nil, err
+	}
+	if len(o.Checksum) == 0 { // listed objects have no checksum
+		if o, err = f.a.st.Head(f.bucket, f.key); err != nil {
+			return nil, err
 		}
-		f.a.mp.Delete(name)
+		f.mu.Lock()
+		f.o = o
+		f.mu.Unlock()
 	}
-	buf := aws.NewWriteAtBuffer([]byte{})
-	n, err := s3manager.NewDownloader(f.a.sess).Download(buf, &s3.GetObjectInput{
-		Bucket: aws.String(f.dir),
-		Key:    aws.String(f.name),
-		Range:  aws.String(fmt.Sprintf("bytes=%v-%v", 0, int64(len(p)-1))),
-	})
+	r, err := f.a.st.Get(f.bucket, f.key, 0, o.Size)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	copy(p, buf.Bytes())
-	if isEof {
-		return int(n), io.EOF
+	defer r.Close()
+	return f.readFull(newVerifier(f.path, o.Checksum, o.Size, r), 0, o.Size)
+}
+
+// readFull reads the n bytes at off of the object from rd
+func (f *file) readFull(rd io.Reader, off, n int64) ([]byte, error) {
+	data := make([]byte, n+1) // reads one more byte to reach EOF
+	m, err := io.ReadFull(rd, data)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		err = nil
+	case nil: // longer than expected
+		m = len(data)
 	}
-	return int(n), nil
+	if err != nil {
+		return nil, err
+	}
+	if int64(m) != n {
+		return nil, &CorruptionError{f.path, fmt.Sprintf("read %v bytes at %v, expected %v", m, off, n)}
+	}
+	return data[:m], nil
+}
+
+func (f *file) Sync() error {
+	if f.dir {
+		return nil
+	}
+	err, ok := f.fs.Sync(f.path)
+	switch {
+	case err != nil:
+		return err
+	case f.a.dura != SyncRemote && f.fs.Mode(f.path)&cfs.WriteThrough == 0:
+		return nil
+	case !ok: // not in cache, the contents are in or on the way to the object store
+		return f.wait(f.path)
+	}
+	size, gen, ok := f.fs.Version(f.path)
+	if !ok {
+		return f.wait(f.path)
+	}
+	msg := newMessage(size, gen, filepath.Join(f.a.dir, f.path), f.path)
+	if err := f.a.put(msg); err != nil {
+		return err
+	}
+	return f.fs.Clean(msg.rowpath, msg.size, msg.gen)
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	if n > 0 {
+		f.off += int64(n)
+	}
+	return n, err
 }
 
 func (f *file) ReadAt(p []byte, off int64) (int, error) {
 	isEof := false
-	if size := int(f.Size()); int(off)+len(p) > size {
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	if int(off)+len(p) > int(size) {
+		if int(off) >= int(size) {
+			return 0, io.EOF
+		}
 		isEof = true
-		p = p[:size-int(off)]
+		p = p[:int(size)-int(off)]
 	}
 	if len(p) == 0 {
 		if isEof {
@@ -388,10 +975,10 @@ func (f *file) ReadAt(p []byte, off int64) (int, error) {
 		}
 		return 0, nil
 	}
-	name := f.dir + "/" + f.name
+	name := f.path
 	if data, err, ok := f.fs.Read(name, off, len(p)); ok {
 		if err != nil {
-			return -1, nil
+			return 0, &CorruptionError{name, err.Error()}
 		}
 		copy(p, data)
 		if isEof {
@@ -399,80 +986,61 @@ func (f *file) ReadAt(p []byte, off int64) (int, error) {
 		}
 		return len(p), nil
 	}
-	if size, ok := f.a.mp.Load(name); ok {
-		for { // waiting for synchronization to complete
-			if md, err := f.a.cli.HeadObject(&s3.HeadObjectInput{
-				Bucket: aws.String(f.dir),
-				Key:    aws.String(f.name),
-			}); err != nil {
-				if code := err.(awserr.RequestFailure).StatusCode(); code != 403 && code != 404 {
-					return -1, err
-				}
-			} else {
-				if int(*md.ContentLength) == size.(int) {
-					break
-				}
+	if err := f.wait(name); err != nil { // waiting for synchronization to complete
+		return 0, err
+	}
+	if f.fs.Mode(name)&cfs.CacheOnRead != 0 {
+		if err := f.fill(); err != nil {
+			return 0, err
+		}
+		if data, err, ok := f.fs.Read(name, off, len(p)); ok && err == nil {
+			copy(p, data)
+			if isEof {
+				return len(p), io.EOF
 			}
+			return len(p), nil
 		}
-		f.a.mp.Delete(name)
 	}
-	buf := aws.NewWriteAtBuffer([]byte{})
-	n, err := s3manager.NewDownloader(f.a.sess).Download(buf, &s3.GetObjectInput{
-		Bucket: aws.String(f.dir),
-		Key:    aws.String(f.name),
-		Range:  aws.String(fmt.Sprintf("bytes=%v-%v", off, off+int64(len(p)-1))),
-	})
+	n, err := f.read(p, off, size)
 	if err != nil {
-		return -1, err
+		return 0, err
 	}
-	copy(p, buf.Bytes())
 	if isEof {
-		return int(n), io.EOF
+		return n, io.EOF
 	}
-	return int(n), nil
+	return n, nil
 }
 
 func (f *file) Write(p []byte) (int, error) {
-	name := f.dir + "/" + f.name
+	name := f.path
 	if err, ok := f.fs.Write(name, p); ok {
 		return len(p), err
 	}
-	if size, ok := f.a.mp.Load(name); ok {
-		for { // waiting for synchronization to complete
-			if md, err := f.a.cli.HeadObject(&s3.HeadObjectInput{
-				Bucket: aws.String(f.dir),
-				Key:    aws.String(f.name),
-			}); err != nil {
-				if code := err.(awserr.RequestFailure).StatusCode(); code != 403 && code != 404 {
-					return -1, err
-				}
-			} else {
-				if int(*md.ContentLength) == size.(int) {
-					break
-				}
-			}
-		}
-		f.a.mp.Delete(name)
+	if err := f.wait(name); err != nil { // waiting for synchronization to complete
+		return 0, err
 	}
 	{
-		size := int(f.Size())
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
 		data := make([]byte, size)
-		n, err := f.Read(data)
+		n, err := f.ReadAt(data, 0)
 		switch {
-		case err != nil:
-			return -1, nil
-		case n != size:
-			return -1, errors.New("write failed")
+		case err != nil && err != io.EOF: // an empty file is at its end
+			return 0, err
+		case n != int(size):
+			return 0, errors.New("write failed")
 		}
 		if err = f.fs.Create(name); err != nil {
-			return -1, err
+			return 0, err
 		}
 		if err, _ := f.fs.Write(name, data); err != nil {
-			return -1, err
+			return 0, err
 		}
 	}
 	if err, _ := f.fs.Write(name, p); err != nil {
-		return -1, err
+		return 0, err
 	}
 	return len(p), nil
 }
@@ -482,31 +1050,35 @@ func (f *file) Stat() (os.FileInfo, error) {
 }
 
 func (f *file) Name() string {
-	if len(f.name) == 0 {
-		return f.dir
-	}
-	return f.name
+	return path.Base(f.path)
 }
 
 func (f *file) Size() int64 {
-	if len(f.name) == 0 {
-		return 0
+	size, err := f.size()
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// size returns the size of the file, or the error of the head of its
+// object.
+func (f *file) size() (int64, error) {
+	if f.dir {
+		return 0, nil
 	}
-	name := f.dir + "/" + f.name
+	name := f.path
 	if size, ok := f.fs.IsExist(name); ok {
-		return size
+		return size, nil
 	}
-	if size, ok := f.a.mp.Load(name); ok {
-		return int64(size.(int))
+	if v, ok := f.a.mp.Load(name); ok {
+		return int64(v.(*message).size), nil
 	}
-	if md, err := f.a.cli.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(f.dir),
-		Key:    aws.String(f.name),
-	}); err != nil {
-		return -1
-	} else {
-		return *md.ContentLength
+	o, err := f.head()
+	if err != nil {
+		return -1, err
 	}
+	return o.Size, nil
 }
 
 func (f *file) Mode() os.FileMode {
@@ -514,29 +1086,91 @@ func (f *file) Mode() os.FileMode {
 }
 
 func (f *file) ModTime() time.Time {
+	if !f.dir {
+		if _, ok := f.fs.IsExist(f.path); ok {
+			if fi, err := os.Stat(filepath.Join(f.a.dir, f.path)); err == nil {
+				return fi.ModTime()
+			}
+		}
+		if o, err := f.head(); err == nil {
+			return o.LastModified
+		}
+	}
 	return time.Now()
 }
 
 func (f *file) IsDir() bool {
-	return len(f.name) == 0
+	return f.dir
 }
 
 func (f *file) Sys() interface{} {
 	return nil
 }
 
-func writeback(usr interface{}, path string, rowpath string, size int) {
+func writeback(usr interface{}, path string, rowpath string, size int, gen uint64) {
 	a := usr.(*alis3)
 	if size >= 0 {
-		a.mp.Store(rowpath, size)
-		a.mch <- &message{path, rowpath}
+		msg := newMessage(size, gen, path, rowpath)
+		a.mp.Store(rowpath, msg)
+		a.queue(msg)
 	} else {
 		if _, ok := a.mp.Load(rowpath); !ok {
-			if isSST(rowpath) {
-				os.Remove(path)
-			}
+			os.Remove(path)
+		}
+	}
+}
+
+// freeSpace returns the space available to unprivileged users on the
+// disk of dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+func newMessage(size int, gen uint64, path, rowpath string) *message {
+	return &message{size, gen, path, rowpath, make(chan struct{})}
+}
+
+// split splits name into bucket and key
+func split(name string) (string, string) {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("write back of %s failed: %v", e.Path, e.Err)
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s is corrupted: %s", e.Path, e.Err)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == engine.Corruption
+}
+
+func newVerifier(path, sum string, size int64, r io.Reader) *verifier {
+	return &verifier{path: path, sum: sum, size: size, h: store.NewHash(), r: r}
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF {
+		switch {
+		case v.n != v.size:
+			return n, &CorruptionError{v.path, fmt.Sprintf("size %v, expected %v", v.n, v.size)}
+		case len(v.sum) > 0 && store.Checksum(v.h) != v.sum:
+			return n, &CorruptionError{v.path, fmt.Sprintf("checksum %s, expected %s", store.Checksum(v.h), v.sum)}
 		}
 	}
+	return n, err
 }
 
 func isSST(path string) bool {
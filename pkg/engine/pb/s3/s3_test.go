@@ -0,0 +1,800 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepfabric/thinkkv/pkg/engine"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/cfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/fault"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
+)
+
+func TestS3(t *testing.T) {
+	testReopen(t, "test", &Config{CacheSize: 1 << 20}, store.NewMem())
+}
+
+func TestBlockCache(t *testing.T) {
+	testReopen(t, "test", &Config{CacheSize: 1 << 20, BlockCacheSize: 1 << 20, BlockSize: 4096, Readahead: 2}, store.NewMem())
+}
+
+func TestCachePolicy(t *testing.T) {
+	for _, name := range []string{cfs.LRU, cfs.ARC, cfs.GDSF} {
+		t.Run(name, func(t *testing.T) {
+			testReopen(t, "test", &Config{CacheSize: 256 << 10, CachePolicy: name}, store.NewMem())
+		})
+	}
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, _, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir, CachePolicy: "fifo"}, store.NewMem()); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+	a, fs, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir, CachePolicy: cfs.ARC}, store.NewMem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	defer fs.Close()
+	if err := a.MkdirAll("test", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Create("test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	if f, err = a.Open("test/a"); err != nil {
+		t.Fatal(err)
+	}
+	f.Read(make([]byte, 5))
+	f.Close()
+	if st := a.CacheStats(); st.Policy != cfs.ARC || st.Files != 1 || st.Hits == 0 || st.Details["t2_bytes"] != 5 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestCacheRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	st.CreateBucket("test")
+	st.Put("test", "000001.sst", strings.NewReader("data"), "")
+	a, _, err := Open(&Config{
+		CacheSize:   64 << 10,
+		CacheDir:    dir,
+		CachePolicy: cfs.LRU,
+		CacheRules:  []cfs.Rule{{Pattern: "*.sst", Mode: cfs.CacheOnRead}, {Pattern: "*.wt", Mode: cfs.WriteThrough}},
+		PinLevels:   1,
+	}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	f, err := a.Open("test/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.ReadAt(make([]byte, 2), 1); n != 2 || err != nil {
+		t.Fatalf("read: %v, %v", n, err)
+	}
+	if !a.IsCached("test/000001.sst") {
+		t.Fatal("read file not cached")
+	}
+	if f, err = a.Create("test/a.wt"); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := st.Head("test", "a.wt"); err != nil || o.Size != 4 {
+		t.Fatalf("not written through: %v", err)
+	}
+	for i := 2; i < 8; i++ {
+		name := fmt.Sprintf("test/%06d.sst", i)
+		if f, err = a.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		f.Write(make([]byte, 16<<10))
+		f.Close()
+		a.TableLevel(name, i-2)
+	}
+	if !a.IsCached("test/000002.sst") || a.IsCached("test/000003.sst") {
+		t.Fatal("level 0 is not pinned")
+	}
+}
+
+func TestDiskWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const minFree = 1 << 30
+	a, _, err := Open(&Config{
+		CacheSize: 1 << 20,
+		CacheDir:  dir,
+		DiskWatch: DiskWatch{MinFree: minFree, Interval: time.Hour},
+	}, store.NewMem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	var free int64 = 1 << 40
+	a.free = func(_ string) (int64, error) { return free, nil }
+	a.resize()
+	if err := a.MkdirAll("test", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		f, err := a.Create(fmt.Sprintf("test/%06d.sst", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(make([]byte, 16<<10))
+		f.Close()
+	}
+	free = minFree - 64<<10
+	a.resize()
+	if st := a.CacheStats(); st.Limit != 64<<10 || st.Size >= 64<<10 {
+		t.Fatalf("cache not shrunk: %+v", st)
+	}
+	free = 1 << 40
+	a.resize()
+	if st := a.CacheStats(); st.Limit != 1<<20 {
+		t.Fatalf("cache not restored: %+v", st)
+	}
+	a.SetLimit(32 << 10)
+	if st := a.CacheStats(); st.Limit != 32<<10 || st.Size >= 32<<10 {
+		t.Fatalf("cache not resized: %+v", st)
+	}
+}
+
+func TestRenameQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	a, _, err := Open(&Config{CacheSize: 16, CacheDir: dir, CachePolicy: cfs.LRU}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.MkdirAll("test", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Create("test/CURRENT.dbtmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 32))
+	f.Close()
+	if _, err := a.Create("test/LOCK"); err != nil { // queues the write back of the pinned file
+		t.Fatal(err)
+	}
+	if _, ok := a.mp.Load("test/CURRENT.dbtmp"); !ok {
+		t.Fatal("write back not queued")
+	}
+	if err := a.Rename("test/CURRENT.dbtmp", "test/CURRENT"); err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	if pend, err := a.Shutdown(context.Background()); len(pend) > 0 || err != nil {
+		t.Fatalf("pending %v: %v", pend, err)
+	}
+	if err := a.Err(); err != nil {
+		t.Fatalf("write back failed: %v", err)
+	}
+	if o, err := st.Head("test", "CURRENT"); err != nil || o.Size != 32 {
+		t.Fatalf("head: %v", err)
+	}
+}
+
+func TestRemoveQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	a, _, err := Open(&Config{CacheSize: 16, CacheDir: dir, CachePolicy: cfs.LRU}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.MkdirAll("test", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Create("test/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 32))
+	f.Close()
+	if _, err := a.Create("test/000002.sst"); err != nil { // evicts the first file
+		t.Fatal(err)
+	}
+	if _, ok := a.mp.Load("test/000001.sst"); !ok || a.IsCached("test/000001.sst") {
+		t.Fatal("write back not queued")
+	}
+	if err := a.Remove("test/000001.sst"); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if _, ok := a.mp.Load("test/000001.sst"); ok {
+		t.Fatal("write back of the removed file kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test/000001.sst")); !os.IsNotExist(err) {
+		t.Fatalf("cache file kept: %v", err)
+	}
+	go a.Run()
+	if pend, err := a.Shutdown(context.Background()); len(pend) > 0 || err != nil {
+		t.Fatalf("pending %v: %v", pend, err)
+	}
+	if _, err := st.Head("test", "000001.sst"); !os.IsNotExist(err) {
+		t.Fatalf("removed file written back: %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, _, err := Open(&Config{CacheSize: 16, CacheDir: dir, CachePolicy: cfs.LRU}, store.NewMem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.MkdirAll("test", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Create("test/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 32))
+	f.Close()
+	if _, err := a.Create("test/000002.sst"); err != nil { // evicts the first file
+		t.Fatal(err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- a.newFile("test/000001.sst", false).wait("test/000001.sst") }()
+	// Run is not started, the write backs never complete
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pend, err := a.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if len(pend) == 0 || pend[0] != "test/000001.sst" {
+		t.Fatalf("pending %v", pend)
+	}
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Fatal("unfinished write back waited without error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter of an unfinished write back hangs")
+	}
+}
+
+func TestCacheCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, _, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir}, store.NewMem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	if err := a.MkdirAll("test", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Create("test/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 32))
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(dir, "test/000001.sst"), 16); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.ReadAt(make([]byte, 32), 0); n != 0 || !errors.Is(err, engine.Corruption) {
+		t.Fatalf("read: %v, %v", n, err)
+	}
+}
+
+func TestHeadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inj := fault.New(0)
+	st := inj.Store(store.NewMem())
+	st.CreateBucket("test")
+	st.Put("test", "000001.sst", strings.NewReader("data"), "")
+	a, _, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir, BlockCacheSize: 1 << 20}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	inj.Add(&fault.Rule{Ops: fault.Head, Pattern: "test/000001.sst"})
+	if n, err := a.newFile("test/000001.sst", false).ReadAt(make([]byte, 4), 0); n != 0 || !errors.Is(err, fault.ErrInjected) {
+		t.Fatalf("read: %v, %v", n, err)
+	}
+}
+
+func TestSingleBucket(t *testing.T) {
+	st := store.NewMem()
+	st.CreateBucket("kv")
+	testReopen(t, "test", &Config{CacheSize: 1 << 20, Layout: SingleBucket, Bucket: "kv", Prefix: "tenant"}, st)
+	resp, err := st.List("kv", "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range resp.Objects {
+		if !strings.HasPrefix(o.Key, "tenant/test/") {
+			t.Fatalf("unexpected key: %v", o.Key)
+		}
+	}
+}
+
+func TestNestedPaths(t *testing.T) {
+	st := store.NewMem()
+	testReopen(t, "test/a/b/db", &Config{CacheSize: 1 << 20}, st)
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, fs, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if fi, err := a.Stat("test/a/b"); err != nil || !fi.IsDir() {
+		t.Fatalf("stat: %v", err)
+	}
+	if names, err := a.List("test/a"); err != nil || len(names) != 1 || names[0] != "b" {
+		t.Fatalf("list: %v, %v", names, err)
+	}
+	if _, err := a.Stat("test/a/c"); !os.IsNotExist(err) {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := a.RemoveAll("test/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Stat("test/a/b/db"); !os.IsNotExist(err) {
+		t.Fatalf("stat: %v", err)
+	}
+}
+
+// testReopen writes a database, then opens it with an empty cache and reads it back
+func testReopen(t *testing.T, name string, cfg *Config, st store.ObjectStore) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 2; i++ {
+		cfg.CacheDir = fmt.Sprintf("%s/%v", dir, i)
+		a, fs, err := Open(cfg, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go a.Run()
+		db, err := pb.Open(name, a, &pb.Options{MemTableSize: 1 << 20, SyncWrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			k := []byte(fmt.Sprintf("%04d", j))
+			if i == 0 {
+				if err := db.Set(k, make([]byte, 1024)); err != nil {
+					t.Fatal(err)
+				}
+			} else if v, err := db.Get(k); err != nil || len(v) != 1024 {
+				t.Fatalf("get %v: %v", j, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		fs.Close()
+		a.Stop()
+	}
+}
+
+type denyStore struct {
+	store.ObjectStore
+}
+
+func (_ denyStore) Put(_, _ string, _ io.Reader, _ string) (*store.Object, error) {
+	return nil, os.ErrPermission
+}
+
+func TestUploadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var infos []UploadFailInfo
+	a, fs, err := Open(&Config{
+		CacheSize: 1 << 20,
+		CacheDir:  dir,
+		EventListener: EventListener{
+			UploadFailed: func(info UploadFailInfo) { infos = append(infos, info) },
+		},
+	}, denyStore{store.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	f, err := a.Create("test/000001.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	a.Stop()
+	if err := a.Err(); err == nil {
+		t.Fatal("upload failure not reported")
+	}
+	if len(infos) != 1 || infos[0].Attempts != 1 || infos[0].Path != "test/000001.log" {
+		t.Fatalf("upload failures: %+v", infos)
+	}
+}
+
+type noCopyStore struct {
+	store.ObjectStore
+}
+
+func (_ noCopyStore) Copy(_, _, _, _ string) error {
+	return engine.NotSupport
+}
+
+func TestRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, st := range []store.ObjectStore{store.NewMem(), noCopyStore{store.NewMem()}} {
+		st.CreateBucket("test")
+		st.Put("test", "a", strings.NewReader("data"), "")
+		a, fs, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir}, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Rename("test/a", "test/b"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.Head("test", "a"); !os.IsNotExist(err) {
+			t.Fatalf("head: %v", err)
+		}
+		if o, err := st.Head("test", "b"); err != nil || o.Size != 4 {
+			t.Fatalf("head: %v", err)
+		}
+		fs.Close()
+	}
+}
+
+func TestSyncRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	a, fs, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir, Durability: SyncRemote}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err := a.MkdirAll("test", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Create("test/000001.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := f.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if o, err := st.Head("test", "000001.log"); err != nil || o.Size != int64(4*(i+1)) {
+			t.Fatalf("head: %v", err)
+		}
+	}
+}
+
+type headStore struct {
+	store.ObjectStore
+	n int
+}
+
+func (s *headStore) Head(bucket, key string) (*store.Object, error) {
+	s.n++
+	return s.ObjectStore.Head(bucket, key)
+}
+
+func TestMetadataCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := &headStore{ObjectStore: store.NewMem()}
+	st.CreateBucket("test")
+	st.Put("test", "a", strings.NewReader("data"), "")
+	a, fs, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err := a.List("test"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		fi, err := a.Stat("test/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 4 || fi.ModTime().IsZero() || time.Since(fi.ModTime()) > time.Minute {
+			t.Fatalf("stat: %v %v", fi.Size(), fi.ModTime())
+		}
+		if st.n != i { // the listed metadata is used once
+			t.Fatalf("%v heads", st.n)
+		}
+		if _, ok := a.mds.Load("test/a"); ok {
+			t.Fatal("metadata kept after use")
+		}
+	}
+	if err := a.Remove("test/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Stat("test/a"); !os.IsNotExist(err) {
+		t.Fatalf("stat: %v", err)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	st.CreateBucket("test")
+	n := 2*store.MaxKeys + 10
+	for i := 0; i < n; i++ {
+		st.Put("test", fmt.Sprintf("%06d.sst", i), strings.NewReader("data"), "")
+	}
+	st.Put("test", "sub/a", strings.NewReader("data"), "")
+	a, fs, err := Open(&Config{CacheSize: 1 << 20, CacheDir: dir}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err := a.Create("test/LOCAL"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := a.List("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := make(map[string]struct{})
+	for _, name := range names {
+		if _, ok := mp[name]; ok {
+			t.Fatalf("duplicate %v", name)
+		}
+		mp[name] = struct{}{}
+	}
+	if len(mp) != n+2 {
+		t.Fatalf("%v names", len(mp))
+	}
+	for _, name := range []string{"000000.sst", fmt.Sprintf("%06d.sst", n-1), "sub", "LOCAL"} {
+		if _, ok := mp[name]; !ok {
+			t.Fatalf("missing %v", name)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.NewMem()
+	st.CreateBucket("test")
+	st.Put("test", "a", strings.NewReader("data"), "deadbeef")
+	st.Put("test", "b", strings.NewReader("data"), "")
+	st.Put("test", "000001.sst", strings.NewReader("data"), "deadbeef")
+	a, fs, err := Open(&Config{
+		CacheSize:  1 << 20,
+		CacheDir:   dir,
+		CacheRules: []cfs.Rule{{Pattern: "*.sst", Mode: cfs.CacheOnRead}, {Pattern: "*", Mode: cfs.Pin}},
+	}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	f, err := a.Open("test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(make([]byte, 4), 0); !errors.Is(err, engine.Corruption) {
+		t.Fatalf("read: %v", err)
+	}
+	if f, err = a.Open("test/b"); err != nil {
+		t.Fatal(err)
+	}
+	st.Put("test", "b", strings.NewReader("da"), "") // truncated behind the cached size
+	if _, err := f.ReadAt(make([]byte, 2), 1); !errors.Is(err, engine.Corruption) {
+		t.Fatalf("read: %v", err)
+	}
+	if f, err = a.Open("test/000001.sst"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(make([]byte, 2), 1); !errors.Is(err, engine.Corruption) { // filled as a whole
+		t.Fatalf("read: %v", err)
+	}
+	if a.IsCached("test/000001.sst") {
+		t.Fatal("corrupted file cached")
+	}
+	if f, err = a.Create("test/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := fs.Close(); err != nil { // writes back test/c
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		o, err := st.Head("test", "c")
+		if err == nil && o.Checksum == "" {
+			t.Fatal("no checksum")
+		}
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("head: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/credentials"
+	if err := ioutil.WriteFile(file, []byte("[p]\naws_access_key_id = file\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_PROFILE", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Unsetenv(k)
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "env")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	for _, c := range []struct {
+		cfg Config
+		id  string
+	}{
+		{Config{AccessKeyID: "static", AccessKeySecret: "secret", SessionToken: "token"}, "static"},
+		{Config{}, "env"},
+	} {
+		sess, err := newSession(&c.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := sess.Config.Credentials.Get(); err != nil || v.AccessKeyID != c.id {
+			t.Fatalf("credentials: %v, %v", v, err)
+		}
+	}
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	sess, err := newSession(&Config{Credentials: Credentials{Profile: "p", Files: []string{file}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := sess.Config.Credentials.Get(); err != nil || v.AccessKeyID != "file" {
+		t.Fatalf("credentials: %v, %v", v, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mem := store.NewMem()
+	mem.CreateBucket("test")
+	inj := fault.New(0)
+	inj.Add(&fault.Rule{Ops: fault.Put, Latency: time.Second})
+	cfg := &Config{CacheSize: 1 << 20, CacheDir: dir}
+	a, _, err := Open(cfg, inj.Store(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run()
+	f, err := a.Create("test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil { // buffered by the cache
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	names, err := a.Shutdown(ctx)
+	if err != context.DeadlineExceeded || len(names) != 1 || names[0] != "test/a" {
+		t.Fatalf("shutdown: %v, %v", names, err)
+	}
+	if f, err = a.Create("test/b"); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	if names, _ = a.Shutdown(context.Background()); len(names) != 2 {
+		t.Fatalf("pending: %v", names)
+	}
+	if a, _, err = Open(cfg, mem); err != nil { // written back from the journal
+		t.Fatal(err)
+	}
+	go a.Run()
+	defer a.Stop()
+	for _, key := range []string{"a", "b"} {
+		for i := 0; ; i++ {
+			o, err := mem.Head("test", key)
+			if err == nil && o.Size == 4 {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("head %v: %v", key, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// NewAWS returns a store backed by the s3 service of sess, acl is the
+// canned acl of uploaded objects.
+func NewAWS(sess *session.Session, acl string) *awsStore {
+	return &awsStore{acl, s3.New(sess), sess}
+}
+
+func (s *awsStore) CreateBucket(bucket string) error {
+	if _, err := s.cli.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == 409 {
+			return nil
+		}
+		return err
+	}
+	return s.cli.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+}
+
+func (s *awsStore) DeleteBucket(bucket string) error {
+	iter := s3manager.NewDeleteListIterator(s.cli, &s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+	})
+	if err := s3manager.NewBatchDeleteWithClient(s.cli).Delete(aws.BackgroundContext(), iter); err != nil {
+		return convert(err)
+	}
+	if _, err := s.cli.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return convert(err)
+	}
+	return s.cli.WaitUntilBucketNotExists(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+}
+
+func (s *awsStore) Put(bucket, key string, r io.Reader, checksum string) (*Object, error) {
+	cr := &countReader{r: r}
+	in := &s3manager.UploadInput{
+		ACL:    aws.String(s.acl),
+		Body:   cr,
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if len(checksum) > 0 {
+		in.Metadata = map[string]*string{MetaChecksum: aws.String(checksum)}
+	}
+	_, err := s3manager.NewUploader(s.sess).Upload(in)
+	if err != nil {
+		return nil, convert(err)
+	}
+	// the output of the upload has no etag nor modification time
+	if o, err := s.Head(bucket, key); err == nil {
+		return o, nil
+	}
+	return &Object{Key: key, Size: cr.n, Checksum: checksum}, nil
+}
+
+func (s *awsStore) Get(bucket, key string, off, n int64) (io.ReadCloser, error) {
+	in := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	switch {
+	case n == 0:
+		return emptyReader{}, nil
+	case n > 0:
+		in.Range = aws.String(fmt.Sprintf("bytes=%v-%v", off, off+n-1))
+	case off > 0:
+		in.Range = aws.String(fmt.Sprintf("bytes=%v-", off))
+	}
+	resp, err := s.cli.GetObject(in)
+	if err != nil {
+		return nil, convert(err)
+	}
+	return resp.Body, nil
+}
+
+func (s *awsStore) Head(bucket, key string) (*Object, error) {
+	resp, err := s.cli.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, convert(err)
+	}
+	return &Object{
+		Key:          key,
+		Size:         aws.Int64Value(resp.ContentLength),
+		ETag:         aws.StringValue(resp.ETag),
+		LastModified: aws.TimeValue(resp.LastModified),
+		Checksum:     metadata(resp.Metadata, MetaChecksum),
+	}, nil
+}
+
+func (s *awsStore) Delete(bucket, key string) error {
+	_, err := s.cli.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return convert(err)
+}
+
+func (s *awsStore) List(bucket, prefix, delimiter, token string, max int) (*ListResult, error) {
+	if max <= 0 {
+		max = MaxKeys
+	}
+	in := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		MaxKeys: aws.Int64(int64(max)),
+	}
+	if len(prefix) > 0 {
+		in.Prefix = aws.String(prefix)
+	}
+	if len(delimiter) > 0 {
+		in.Delimiter = aws.String(delimiter)
+	}
+	if len(token) > 0 {
+		in.ContinuationToken = aws.String(token)
+	}
+	resp, err := s.cli.ListObjectsV2(in)
+	if err != nil {
+		return nil, convert(err)
+	}
+	r := &ListResult{}
+	for _, item := range resp.Contents {
+		r.Objects = append(r.Objects, Object{
+			Key:          aws.StringValue(item.Key),
+			Size:         aws.Int64Value(item.Size),
+			ETag:         aws.StringValue(item.ETag),
+			LastModified: aws.TimeValue(item.LastModified),
+		})
+	}
+	for _, p := range resp.CommonPrefixes {
+		r.Prefixes = append(r.Prefixes, aws.StringValue(p.Prefix))
+	}
+	if aws.BoolValue(resp.IsTruncated) {
+		r.Token = aws.StringValue(resp.NextContinuationToken)
+	}
+	return r, nil
+}
+
+func (s *awsStore) Copy(srcBucket, srcKey, dstBucket, dstKey string) error {
+	o, err := s.Head(srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	src := (&url.URL{Path: srcBucket + "/" + srcKey}).EscapedPath()
+	if o.Size <= MaxCopySize {
+		_, err := s.cli.CopyObject(&s3.CopyObjectInput{
+			ACL:        aws.String(s.acl),
+			Bucket:     aws.String(dstBucket),
+			Key:        aws.String(dstKey),
+			CopySource: aws.String(src),
+		})
+		return convert(err)
+	}
+	in := &s3.CreateMultipartUploadInput{ // metadata is not copied by UploadPartCopy
+		ACL:    aws.String(s.acl),
+		Bucket: aws.String(dstBucket),
+		Key:    aws.String(dstKey),
+	}
+	if len(o.Checksum) > 0 {
+		in.Metadata = map[string]*string{MetaChecksum: aws.String(o.Checksum)}
+	}
+	resp, err := s.cli.CreateMultipartUpload(in)
+	if err != nil {
+		return convert(err)
+	}
+	var parts []*s3.CompletedPart
+	for off, n := int64(0), int64(1); off < o.Size; off, n = off+CopyPartSize, n+1 {
+		end := off + CopyPartSize - 1
+		if end >= o.Size {
+			end = o.Size - 1
+		}
+		part, err := s.cli.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dstKey),
+			CopySource:      aws.String(src),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%v-%v", off, end)),
+			PartNumber:      aws.Int64(n),
+			UploadId:        resp.UploadId,
+		})
+		if err != nil {
+			s.cli.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(dstBucket),
+				Key:      aws.String(dstKey),
+				UploadId: resp.UploadId,
+			})
+			return convert(err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+	_, err = s.cli.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dstBucket),
+		Key:             aws.String(dstKey),
+		UploadId:        resp.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return convert(err)
+}
+
+func isRetryable(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		switch code := e.StatusCode(); {
+		case code == 408, code == 429, code >= 500:
+			return true
+		case code >= 400:
+			return false
+		}
+	}
+	return true
+}
+
+// metadata looks up the metadata k, the keys returned by s3 are canonicalized
+func metadata(mp map[string]*string, k string) string {
+	for key, v := range mp {
+		if strings.EqualFold(key, k) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// convert maps the errors of missing objects and buckets to os.ErrNotExist
+func convert(err error) error {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		switch e.StatusCode() {
+		case 403, 404:
+			return os.ErrNotExist
+		}
+	}
+	return err
+}
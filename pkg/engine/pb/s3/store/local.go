@@ -0,0 +1,179 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewLocal returns a store which keeps every bucket as a directory under dir.
+func NewLocal(dir string) (*localStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, ".tmp"), os.FileMode(0774)); err != nil {
+		return nil, err
+	}
+	return &localStore{dir}, nil
+}
+
+func (s *localStore) CreateBucket(bucket string) error {
+	return os.MkdirAll(filepath.Join(s.dir, bucket), os.FileMode(0774))
+}
+
+func (s *localStore) DeleteBucket(bucket string) error {
+	if _, err := os.Stat(filepath.Join(s.dir, bucket)); err != nil {
+		return err
+	}
+	os.RemoveAll(filepath.Join(s.dir, SumDir, bucket))
+	return os.RemoveAll(filepath.Join(s.dir, bucket))
+}
+
+func (s *localStore) Put(bucket, key string, r io.Reader, checksum string) (*Object, error) {
+	if _, err := os.Stat(filepath.Join(s.dir, bucket)); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Join(s.dir, ".tmp"), "put")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	path := s.path(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0774)); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := s.setChecksum(bucket, key, checksum); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return s.Head(bucket, key)
+}
+
+func (s *localStore) Get(bucket, key string, off, n int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if n < 0 {
+		return f, nil
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, n), f}, nil
+}
+
+func (s *localStore) Head(bucket, key string) (*Object, error) {
+	fi, err := os.Stat(s.path(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	o := object(key, fi)
+	if data, err := ioutil.ReadFile(s.sumPath(bucket, key)); err == nil {
+		o.Checksum = string(data)
+	}
+	return o, nil
+}
+
+func (s *localStore) Delete(bucket, key string) error {
+	path := s.path(bucket, key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(s.sumPath(bucket, key))
+	root := filepath.Join(s.dir, bucket)
+	for dir := filepath.Dir(path); dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil { // not empty
+			break
+		}
+	}
+	return nil
+}
+
+func (s *localStore) List(bucket, prefix, delimiter, token string, max int) (*ListResult, error) {
+	var objs []Object
+
+	root := filepath.Join(s.dir, bucket)
+	if err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		key, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, *object(filepath.ToSlash(key), fi))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return list(objs, prefix, delimiter, token, max), nil
+}
+
+func (s *localStore) Copy(srcBucket, srcKey, dstBucket, dstKey string) error {
+	o, err := s.Head(srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	r, err := s.Get(srcBucket, srcKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = s.Put(dstBucket, dstKey, r, o.Checksum)
+	return err
+}
+
+func (s *localStore) path(bucket, key string) string {
+	return filepath.Join(s.dir, bucket, filepath.FromSlash(key))
+}
+
+// sumPath returns the file keeping the checksum of the object
+func (s *localStore) sumPath(bucket, key string) string {
+	return filepath.Join(s.dir, SumDir, bucket, filepath.FromSlash(key))
+}
+
+func (s *localStore) setChecksum(bucket, key, checksum string) error {
+	path := s.sumPath(bucket, key)
+	if len(checksum) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0774)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(checksum), os.FileMode(0664))
+}
+
+func object(key string, fi os.FileInfo) *Object {
+	return &Object{
+		Key:          key,
+		Size:         fi.Size(),
+		ETag:         fmt.Sprintf("%x-%x", fi.Size(), fi.ModTime().UnixNano()),
+		LastModified: fi.ModTime(),
+	}
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// NewMem returns an in-memory store, mainly for tests.
+func NewMem() *memStore {
+	return &memStore{mp: make(map[string]map[string]*memObject)}
+}
+
+func (s *memStore) CreateBucket(bucket string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.mp[bucket]; !ok {
+		s.mp[bucket] = make(map[string]*memObject)
+	}
+	return nil
+}
+
+func (s *memStore) DeleteBucket(bucket string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.mp[bucket]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.mp, bucket)
+	return nil
+}
+
+func (s *memStore) Put(bucket, key string, r io.Reader, checksum string) (*Object, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.mp[bucket]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	o := &memObject{data, checksum, time.Now()}
+	b[key] = o
+	return o.object(key), nil
+}
+
+func (s *memStore) Get(bucket, key string, off, n int64) (io.ReadCloser, error) {
+	s.RLock()
+	defer s.RUnlock()
+	o, ok := s.mp[bucket][key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	data := o.data
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	data = data[off:]
+	if n >= 0 && n < int64(len(data)) {
+		data = data[:n]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStore) Head(bucket, key string) (*Object, error) {
+	s.RLock()
+	defer s.RUnlock()
+	o, ok := s.mp[bucket][key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return o.object(key), nil
+}
+
+func (s *memStore) Delete(bucket, key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if b, ok := s.mp[bucket]; ok {
+		delete(b, key)
+	}
+	return nil
+}
+
+func (s *memStore) List(bucket, prefix, delimiter, token string, max int) (*ListResult, error) {
+	s.RLock()
+	b, ok := s.mp[bucket]
+	if !ok {
+		s.RUnlock()
+		return nil, os.ErrNotExist
+	}
+	objs := make([]Object, 0, len(b))
+	for k, o := range b {
+		objs = append(objs, *o.object(k))
+	}
+	s.RUnlock()
+	return list(objs, prefix, delimiter, token, max), nil
+}
+
+func (s *memStore) Copy(srcBucket, srcKey, dstBucket, dstKey string) error {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.mp[srcBucket][srcKey]
+	if !ok {
+		return os.ErrNotExist
+	}
+	b, ok := s.mp[dstBucket]
+	if !ok {
+		return os.ErrNotExist
+	}
+	b[dstKey] = &memObject{o.data, o.sum, time.Now()} // objects are immutable, share the data
+	return nil
+}
+
+func (o *memObject) object(key string) *Object {
+	return &Object{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		ETag:         fmt.Sprintf("%x", md5.Sum(o.data)),
+		LastModified: o.mtime,
+		Checksum:     o.sum,
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// NewHash returns the hash of the checksums of objects.
+func NewHash() hash.Hash32 {
+	return crc32.New(castagnoli)
+}
+
+// Checksum formats the sum of h as the checksum of an object.
+func Checksum(h hash.Hash32) string {
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// IsRetryable reports whether an operation which failed with err may
+// succeed if it is retried. Missing objects and buckets and rejected
+// requests are permanent failures, network and server errors are not.
+func IsRetryable(err error) bool {
+	if err == nil || os.IsNotExist(err) || os.IsPermission(err) {
+		return false
+	}
+	return isRetryable(err)
+}
+
+type countReader struct {
+	n int64
+	r io.Reader
+}
+
+type emptyReader struct{}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (_ emptyReader) Read(_ []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (_ emptyReader) Close() error {
+	return nil
+}
+
+// list pages through objs like ListObjectsV2, the token is the last key
+// or common prefix returned by the previous page.
+func list(objs []Object, prefix, delimiter, token string, max int) *ListResult {
+	if max <= 0 {
+		max = MaxKeys
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+	r := &ListResult{}
+	for i, j := 0, len(objs); i < j; i++ {
+		key := objs[i].Key
+		if !strings.HasPrefix(key, prefix) || (len(token) > 0 && key <= token) {
+			continue
+		}
+		if len(delimiter) > 0 {
+			if k := strings.Index(key[len(prefix):], delimiter); k >= 0 {
+				p := key[:len(prefix)+k+len(delimiter)]
+				if p <= token || (len(r.Prefixes) > 0 && r.Prefixes[len(r.Prefixes)-1] == p) {
+					continue
+				}
+				if len(r.Objects)+len(r.Prefixes) == max {
+					r.Token = r.last()
+					return r
+				}
+				r.Prefixes = append(r.Prefixes, p)
+				continue
+			}
+		}
+		if len(r.Objects)+len(r.Prefixes) == max {
+			r.Token = r.last()
+			return r
+		}
+		r.Objects = append(r.Objects, objs[i])
+	}
+	return r
+}
+
+func (r *ListResult) last() string {
+	var key string
+
+	if n := len(r.Objects); n > 0 {
+		key = r.Objects[n-1].Key
+	}
+	if n := len(r.Prefixes); n > 0 && r.Prefixes[n-1] > key {
+		key = r.Prefixes[n-1]
+	}
+	return key
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ls, err := NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ObjectStore{NewMem(), ls} {
+		if err := s.CreateBucket("b"); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "d/x", "d/y", "e/z", "f"} {
+			h := NewHash()
+			h.Write([]byte(k))
+			if _, err := s.Put("b", k, bytes.NewReader([]byte(k)), Checksum(h)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var keys, prefixes []string
+		for token := ""; ; {
+			r, err := s.List("b", "", "/", token, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, o := range r.Objects {
+				keys = append(keys, o.Key)
+			}
+			prefixes = append(prefixes, r.Prefixes...)
+			if token = r.Token; len(token) == 0 {
+				break
+			}
+		}
+		if !reflect.DeepEqual(keys, []string{"a", "f"}) || !reflect.DeepEqual(prefixes, []string{"d/", "e/"}) {
+			t.Fatalf("list: %v, %v", keys, prefixes)
+		}
+		if err := s.Copy("b", "d/x", "b", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if o, err := s.Head("b", "c"); err != nil || o.Checksum != "bb289990" {
+			t.Fatalf("head: %v, %v", o, err)
+		}
+		r, err := s.Get("b", "c", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := ioutil.ReadAll(r); string(data) != "/" {
+			t.Fatalf("get: %q", data)
+		}
+		r.Close()
+		if err := s.Delete("b", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Head("b", "c"); !os.IsNotExist(err) {
+			t.Fatalf("head: %v", err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// MaxKeys is the default page size of List.
+	MaxKeys = 1000
+	// MaxCopySize is the largest object copied by a single CopyObject,
+	// larger objects are copied part by part.
+	MaxCopySize = 5 << 30
+	// CopyPartSize is the size of the parts of a multipart copy.
+	CopyPartSize = 512 << 20
+	// MetaChecksum is the metadata of objects holding their checksum.
+	MetaChecksum = "Crc32c"
+	// SumDir is the directory of the local store keeping checksums.
+	SumDir = ".sum"
+)
+
+// ObjectStore is the storage beneath the s3 filesystem. Missing objects
+// and buckets are reported by os.ErrNotExist.
+type ObjectStore interface {
+	CreateBucket(string) error
+	DeleteBucket(string) error
+
+	// Put stores the data of r, checksum is kept as the metadata of the
+	// object and returned by Head.
+	Put(bucket, key string, r io.Reader, checksum string) (*Object, error)
+	// Get returns n bytes of the object starting at off, n < 0 means
+	// till the end of the object.
+	Get(bucket, key string, off, n int64) (io.ReadCloser, error)
+	Head(bucket, key string) (*Object, error)
+	Delete(bucket, key string) error
+	// List returns at most max keys with the prefix after the
+	// continuation token, keys containing delimiter after the prefix
+	// are rolled up into Prefixes.
+	List(bucket, prefix, delimiter, token string, max int) (*ListResult, error)
+	// Copy copies an object inside the store without transferring its
+	// data through the client, or returns engine.NotSupport.
+	Copy(srcBucket, srcKey, dstBucket, dstKey string) error
+}
+
+type Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Checksum     string // crc32c of the data in hex, empty if unknown
+}
+
+type ListResult struct {
+	Objects  []Object
+	Prefixes []string
+	Token    string // continuation token, empty if the listing is done
+}
+
+type awsStore struct {
+	acl  string
+	cli  *s3.S3
+	sess *session.Session
+}
+
+// local directory store, buckets are directories under dir
+type localStore struct {
+	dir string
+}
+
+type memObject struct {
+	data  []byte
+	sum   string
+	mtime time.Time
+}
+
+// in-memory store
+type memStore struct {
+	sync.RWMutex
+	mp map[string]map[string]*memObject
+}
@@ -1,12 +1,17 @@
 package s3
 
 import (
+	"context"
+	"hash"
+	"io"
 	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/cockroachdb/pebble/vfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/limiter"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/bcache"
 	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/cfs"
+	"github.com/deepfabric/thinkkv/pkg/engine/pb/s3/store"
 )
 
 const (
@@ -15,40 +20,226 @@ const (
 	PublicReadWrite
 )
 
+const (
+	BucketPerDir = iota // the top directory of a path is a bucket
+	SingleBucket        // paths are keys under Config.Prefix of Config.Bucket
+)
+
+const (
+	SyncLocal  = iota // Sync flushes the cache buffer and fsyncs the cache file
+	SyncRemote        // Sync also uploads the contents to the object store
+)
+
+const (
+	DefaultDiskWatchInterval = 10 * time.Second
+)
+
+const (
+	DefaultMaxAttempts = 10
+	DefaultMinBackoff  = 100 * time.Millisecond
+	DefaultMaxBackoff  = 10 * time.Second
+)
+
 type FS interface {
 	vfs.FS
 	Run()
+	// Stop is Shutdown without a deadline.
 	Stop()
+	// Shutdown stops the write back in order: the dirty files of the cache
+	// are flushed and queued, no more write backs are accepted and the
+	// queue is drained until ctx is done. It returns the files which are
+	// not uploaded, they are written back once Run starts after the cache
+	// is opened again. Uploads in progress when ctx is done keep running,
+	// and clean their files in the journal of the closed cache when they
+	// complete; the waiters of the write backs not started fail.
+	Shutdown(context.Context) ([]string, error)
+	IsCached(string) bool
+	// CacheStats returns the statistics of the local cache.
+	CacheStats() cfs.Stats
+	// SetLimit sets the size of the local cache, files are evicted at once
+	// if it shrinks. DiskWatch keeps the cache below it under disk pressure.
+	SetLimit(int)
+	// Err returns the first write back which failed permanently and
+	// has not been retried.
+	Err() error
+	// Retry requeues the write backs which failed.
+	Retry()
 }
 
 type Config struct {
 	CacheSize       int
 	CacheDir        string
+	CachePolicy     string     // eviction policy of the cache, defaults to cfs.TwoQueue
+	CacheRules      []cfs.Rule // modes of files in the cache, followed by cfs.DefaultRules
 	Region          string
 	Endpoint        string
 	AccessKeyID     string
 	AccessKeySecret string
+	SessionToken    string // token of temporary keys
+	Layout          int
+	Durability      int
+	Bucket          string // bucket of the SingleBucket layout
+	Prefix          string // key prefix of the SingleBucket layout
+	EventListener   EventListener
+	Retry           RetryPolicy
+	// Credentials configures the provider chain used if AccessKeyID
+	// is empty.
+	Credentials Credentials
+	// UploadBytesPerSec limits the bandwidth of write back, 0 means
+	// unlimited. Uploads of sst files yield to other files.
+	UploadBytesPerSec int
+	// DiskWatch shrinks the cache when its disk runs out of space.
+	DiskWatch DiskWatch
+	// PinLevels pins the sst files of the levels below it in the cache,
+	// as they are reported by the engine, 0 leaves them to CacheRules.
+	PinLevels int
+	// BlockCacheSize is the capacity in bytes of the cache of remote sst
+	// blocks, 0 disables the cache. BlockSize defaults to 64K, Readahead
+	// is the number of blocks prefetched by sequential reads.
+	BlockCacheSize int
+	BlockSize      int
+	Readahead      int
+}
+
+// Credentials configures the standard provider chain: the environment
+// variables, the shared credentials and config files, web identity token
+// files and the roles of containers and instances. Expiring credentials
+// are refreshed before they expire.
+type Credentials struct {
+	Profile string   // profile of the shared files, defaults to AWS_PROFILE or default
+	Files   []string // shared files, defaults to ~/.aws/credentials and ~/.aws/config
+	// WebIdentityTokenFile and RoleARN assume a role with a web identity
+	// token, which is also looked up in AWS_WEB_IDENTITY_TOKEN_FILE and
+	// AWS_ROLE_ARN if not set. RoleARN and RoleSessionName default to
+	// AWS_ROLE_ARN and AWS_ROLE_SESSION_NAME.
+	WebIdentityTokenFile string
+	RoleARN              string
+	RoleSessionName      string
+	// ExpiryWindow refreshes the credentials of the role this long
+	// before they expire.
+	ExpiryWindow time.Duration
+}
+
+// DiskWatch checks the free space of the disk of the cache every
+// Interval, 0 means DefaultDiskWatchInterval. While the free space is
+// below MinFree bytes the cache is shrunk by the missing space, and it is
+// grown back to its size as the space is freed. 0 disables the watch.
+type DiskWatch struct {
+	MinFree  int64
+	Interval time.Duration
+}
+
+// RetryPolicy controls the retries of write back, the n-th retry waits
+// a random duration in [d/2, d] where d = MinBackoff * 2^n, but at most
+// MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts int           // 0 means DefaultMaxAttempts
+	Deadline    time.Duration // 0 means no deadline
+	MinBackoff  time.Duration // 0 means DefaultMinBackoff
+	MaxBackoff  time.Duration // 0 means DefaultMaxBackoff
+}
+
+type EventListener struct {
+	// ObjectDeleted is invoked when the engine reports the deletion of a
+	// table, with the id of the flush or compaction job which deleted it
+	// and the result of the removal of its remote object.
+	ObjectDeleted func(ObjectDeleteInfo)
+	// UploadFailed is invoked when the write back of a file failed
+	// permanently or ran out of retries.
+	UploadFailed func(UploadFailInfo)
+}
+
+type ObjectDeleteInfo struct {
+	JobID int
+	Path  string
+	Err   error
+}
+
+type UploadFailInfo struct {
+	Path     string
+	Attempts int
+	Err      error
+}
+
+type UploadError struct {
+	Path string
+	Err  error
+}
+
+// CorruptionError reports data of an object which doesn't match its size
+// or checksum, it matches engine.Corruption by errors.Is.
+type CorruptionError struct {
+	Path string
+	Err  string
+}
+
+// verifier checks the data read from r against the size and the checksum
+// of an object when r is drained.
+type verifier struct {
+	path string
+	sum  string // empty if unknown
+	size int64
+	n    int64
+	h    hash.Hash32
+	r    io.Reader
 }
 
 type message struct {
+	size    int
+	gen     uint64 // generation of the file in the cache
 	path    string
 	rowpath string
+	done    chan struct{} // closed when the write back completes or fails
 }
 
 type alis3 struct {
-	cli  *s3.S3
-	fs   cfs.FS
-	opt  string
-	mp   *sync.Map
-	ch   chan struct{}
-	mch  chan *message
-	wg   sync.WaitGroup
-	sess *session.Session
+	fs     cfs.FS
+	st     store.ObjectStore
+	layout int
+	bucket string
+	prefix string
+	mp     *sync.Map // path -> *message, the latest write back of the path
+	dels   *sync.Map // path -> result of the latest remote deletion
+	fails  *sync.Map // path -> *failure
+	ups    *sync.Map // path -> *sync.Mutex, serializes uploads of a path
+	mds    *sync.Map // path -> *store.Object, metadata of remote objects
+	dir    string
+	dura   int
+	pins   int // levels pinned
+	limit  int // size of the cache set by SetLimit
+	watch  DiskWatch
+	wmu    sync.Mutex // serializes the resizes of the cache
+	wstop  chan struct{}
+	free   func(string) (int64, error) // free space of the disk of a directory
+	retry  RetryPolicy
+	errMu  sync.Mutex
+	err    error
+	el     EventListener
+	lim    *limiter.Limiter
+	bc     *bcache.Cache
+	qmu    sync.RWMutex // guards the queue against shutdown
+	closed bool
+	pmu    sync.Mutex
+	pend   map[string]*message // queued and failed write backs
+	quit   chan struct{}       // stops the retries on shutdown
+	ch     chan struct{}
+	mch    chan *message
+	wg     sync.WaitGroup
+}
+
+type failure struct {
+	msg *message
+	err error
 }
 
 type file struct {
-	dir  string
-	name string
-	a    *alis3
-	fs   cfs.FS
+	dir    bool
+	path   string
+	bucket string
+	key    string
+	a      *alis3
+	fs     cfs.FS
+	off    int64 // offset of Read
+	mu     sync.Mutex
+	o      *store.Object // metadata of the remote object, guarded by mu
 }
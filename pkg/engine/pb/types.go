@@ -1,13 +1,121 @@
 package pb
 
-import "github.com/cockroachdb/pebble"
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// EventListener contains hooks for flushes, compactions, table
+// creations and deletions, write stalls and wal creations.
+type EventListener = pebble.EventListener
+
+type (
+	FlushInfo           = pebble.FlushInfo
+	CompactionInfo      = pebble.CompactionInfo
+	TableCreateInfo     = pebble.TableCreateInfo
+	TableDeleteInfo     = pebble.TableDeleteInfo
+	WALCreateInfo       = pebble.WALCreateInfo
+	WriteStallBeginInfo = pebble.WriteStallBeginInfo
+)
+
+const (
+	PauseInterval = 100 * time.Millisecond
+)
+
+const (
+	DefaultWarmParallelism = 4
+)
+
+type Options struct {
+	MemTableSize int
+	ReadOnly     bool
+	SyncWrite    bool
+	// PauseOnError blocks writes while the filesystem reports an error,
+	// instead of failing them.
+	PauseOnError  bool
+	EventListener EventListener
+	// WarmUp prefetches the tables into the cache of a WarmFS when the
+	// database is opened, nil disables it.
+	WarmUp *WarmUp
+}
+
+// WarmUp selects the tables to prefetch: the tables of the levels below
+// Levels are fetched as a whole, and the last TailSize bytes of the other
+// tables, which hold their index and filter blocks, 0 skips them.
+type WarmUp struct {
+	Levels      int
+	TailSize    int
+	Parallelism int // 0 means DefaultWarmParallelism
+	BytesPerSec int // 0 means unlimited
+	// Background returns from Open before the warm up completes, the warm
+	// up is stopped by Close.
+	Background bool
+	// Progress is invoked after every table and once more with Done set
+	// when the warm up ends.
+	Progress func(WarmProgress)
+}
+
+type WarmProgress struct {
+	Tables      int // tables done
+	TotalTables int
+	Bytes       int64 // bytes fetched
+	TotalBytes  int64
+	Failed      int   // tables which failed, they are read on demand
+	Err         error // the first failure
+	Done        bool
+}
+
+// TableListener is implemented by filesystems which want to be told
+// which job deleted a table and whether the deletion succeeded.
+type TableListener interface {
+	TableDeleted(int, string, error)
+}
+
+// LevelListener is implemented by filesystems which want to be told
+// the level of the tables at open and of the tables created by flushes,
+// compactions and ingestions.
+type LevelListener interface {
+	TableLevel(string, int)
+}
+
+// HealthFS is a filesystem which may fail in background, writes are
+// rejected or paused while Err returns an error.
+type HealthFS interface {
+	vfs.FS
+	Err() error
+}
+
+// WarmFS is a filesystem which can prefetch files into its cache,
+// Prefetch reads the given number of bytes at the given offset of a file,
+// or the whole file if the number is negative.
+type WarmFS interface {
+	vfs.FS
+	Prefetch(string, int64, int64) error
+}
+
+// CacheFS is a filesystem which keeps part of its files in a local cache,
+// IsCached reports whether a file is available locally.
+type CacheFS interface {
+	vfs.FS
+	IsCached(string) bool
+}
 
 type pbEngine struct {
-	db  *pebble.DB
-	opt *pebble.WriteOptions
+	name  string
+	pause bool
+	db    *pebble.DB
+	opts  *pebble.Options
+	opt   *pebble.WriteOptions
+	stop  chan struct{} // stops the warm up
+	wg    sync.WaitGroup
 }
 
 type pbBatch struct {
+	e   *pbEngine
 	db  *pebble.DB
 	bat *pebble.Batch
 	opt *pebble.WriteOptions
@@ -20,3 +128,7 @@ type pbIterator struct {
 type pbSnapshot struct {
 	s *pebble.Snapshot
 }
+
+type pbSSTWriter struct {
+	w *sstable.Writer
+}
@@ -3,7 +3,9 @@ package engine
 import "errors"
 
 var (
-	NotExist = errors.New("Not Exist")
+	NotExist   = errors.New("Not Exist")
+	NotSupport = errors.New("Not Support")
+	Corruption = errors.New("Corruption")
 )
 
 type DB interface {
@@ -13,6 +15,16 @@ type DB interface {
 	NewSnapshot() (Snapshot, error)
 	NewIterator([]byte) (Iterator, error)
 
+	// NewSSTWriter creates an sst file at the given path of the
+	// database's filesystem, which can be loaded later by Ingest.
+	NewSSTWriter(string) (SSTWriter, error)
+	Ingest([]string) error
+
+	// Compact compacts the range [start, end] of the lsm tree.
+	Compact([]byte, []byte) error
+	// EstimateSize estimates the disk space used by the range [start, end].
+	EstimateSize([]byte, []byte) (*Size, error)
+
 	Del([]byte) error
 	Set([]byte, []byte) error
 	Get([]byte) ([]byte, error)
@@ -39,3 +51,19 @@ type Snapshot interface {
 	Get([]byte) ([]byte, error)
 	NewIterator([]byte) (Iterator, error)
 }
+
+// Size describes the space used by a key range, Local is the part stored
+// on local disk (including the cache of a remote filesystem) and Remote
+// is the part only available in remote storage.
+type Size struct {
+	Total  uint64
+	Local  uint64
+	Remote uint64
+}
+
+// SSTWriter writes an external sst file, keys must be added in strictly
+// increasing order.
+type SSTWriter interface {
+	Close() error
+	Set([]byte, []byte) error
+}